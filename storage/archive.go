@@ -0,0 +1,428 @@
+package storage
+
+/*
+	zip and tar.gz archives of objects
+	archives are streamed directly between objects, without local copies of the content, except when extracting
+	a zip archive (which must be read from its end), where the archive is first copied to a temporary file.
+	Extraction is limited by default (see ExtractOptions), so a small archive cannot expand without bound
+*/
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat - the type of archive
+type ArchiveFormat int
+
+const (
+	ArchiveAuto  ArchiveFormat = iota // determined by the archive name (.zip, .tar.gz or .tgz)
+	ArchiveZip                        // zip, using deflate compression
+	ArchiveTarGz                      // gzip compressed tar
+)
+
+// ErrUnsafePath - an archive entry would be extracted outside of the destination prefix
+var ErrUnsafePath = errors.New(`storage: unsafe path in archive`)
+
+// ErrArchiveTooLarge - extraction would exceed ExtractOptions.MaxBytes or MaxArchiveBytes
+var ErrArchiveTooLarge = errors.New(`storage: archive content exceeds limit`)
+
+// ArchiveOptions - how an archive is created
+type ArchiveOptions struct {
+	Format      ArchiveFormat
+	StripPrefix string // removed from the start of object names to form entry names
+}
+
+const (
+	defaultExtractBytes = 1 << 30
+	defaultArchiveBytes = 1 << 30
+)
+
+// ExtractOptions - how an archive is extracted
+type ExtractOptions struct {
+	Format ArchiveFormat
+	// MaxBytes - limit on the total uncompressed size of the extracted objects, defaults to 1GiB, negative for no limit
+	MaxBytes int64
+	// MaxArchiveBytes - limit on the size of a zip archive, which is copied to a temporary file to be read,
+	// defaults to 1GiB, negative for no limit
+	MaxArchiveBytes int64
+}
+
+// limit - v, or def when v is zero. Negative values (no limit) are returned as -1
+func limit(v, def int64) int64 {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return -1
+	}
+	return v
+}
+
+// ArchiveEntry - an object added to, or extracted from, an archive
+type ArchiveEntry struct {
+	Name   string // within the archive
+	Object string
+	Bytes  int64
+}
+
+// ArchiveReport - the entries of the archive
+type ArchiveReport struct {
+	Entries []ArchiveEntry
+	Bytes   int64 // total uncompressed size
+}
+
+func (r *ArchiveReport) add(e ArchiveEntry) {
+	r.Entries = append(r.Entries, e)
+	r.Bytes += e.Bytes
+}
+
+// resolve - the format to use for an archive named name
+func (f ArchiveFormat) resolve(name string) (ArchiveFormat, error) {
+	if f != ArchiveAuto {
+		return f, nil
+	}
+	n := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(n, `.zip`):
+		return ArchiveZip, nil
+	case strings.HasSuffix(n, `.tar.gz`) || strings.HasSuffix(n, `.tgz`):
+		return ArchiveTarGz, nil
+	}
+	return f, errors.New(`unknown archive format: ` + name)
+}
+
+// entryName - the name of object within an archive
+func entryName(object string, stripPrefix string) string {
+	if n := strings.TrimPrefix(object, stripPrefix); len(n) > 0 {
+		return n
+	}
+	return object
+}
+
+// safeEntryName - the cleaned name of an entry, rejecting those that are absolute or refer to a parent
+func safeEntryName(name string) (string, error) {
+	n := strings.ReplaceAll(name, `\`, `/`)
+	if strings.HasPrefix(n, `/`) || (len(n) > 1 && n[1] == ':') {
+		return ``, ErrUnsafePath
+	}
+	c := path.Clean(n)
+	if c == `.` || c == `..` || strings.HasPrefix(c, `../`) {
+		return ``, ErrUnsafePath
+	}
+	return c, nil
+}
+
+// CreateArchive - streams the named objects into a new archive object dest
+func CreateArchive(ctx context.Context, st ObjectStore, dest string, objects []string, opts ArchiveOptions) (*ArchiveReport, error) {
+	f, err := opts.Format.resolve(dest)
+	if err != nil {
+		return nil, err
+	}
+	report := new(ArchiveReport)
+	ct := `application/zip`
+	if f == ArchiveTarGz {
+		ct = `application/gzip`
+	}
+	err = writeStream(ctx, st, dest, &WriteOptions{ContentType: ct}, func(w io.Writer) error {
+		if f == ArchiveZip {
+			return writeZip(ctx, st, w, objects, opts.StripPrefix, report)
+		}
+		return writeTarGz(ctx, st, w, objects, opts.StripPrefix, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ArchivePrefix - streams every object below prefix into a new archive object dest, entries are named
+// relative to prefix unless opts.StripPrefix is set
+func ArchivePrefix(ctx context.Context, st ObjectStore, dest string, prefix string, opts ArchiveOptions) (*ArchiveReport, error) {
+	l, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, oa := range l {
+		// the archive itself, and folder placeholders, are not included
+		if oa.Name != dest && !strings.HasSuffix(oa.Name, `/`) {
+			names = append(names, oa.Name)
+		}
+	}
+	sort.Strings(names)
+	if len(opts.StripPrefix) == 0 {
+		opts.StripPrefix = prefix
+	}
+	return CreateArchive(ctx, st, dest, names, opts)
+}
+
+func writeZip(ctx context.Context, st ObjectStore, w io.Writer, objects []string, strip string, report *ArchiveReport) error {
+	zw := zip.NewWriter(w)
+	for _, o := range objects {
+		r, _, modified, err := openEntry(ctx, st, o)
+		if err != nil {
+			return err
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: entryName(o, strip), Method: zip.Deflate, Modified: modified})
+		var n int64
+		if err == nil {
+			n, err = io.Copy(fw, r)
+		}
+		r.Close()
+		if err != nil {
+			return err
+		}
+		report.add(ArchiveEntry{Name: entryName(o, strip), Object: o, Bytes: n})
+	}
+	return zw.Close()
+}
+
+func writeTarGz(ctx context.Context, st ObjectStore, w io.Writer, objects []string, strip string, report *ArchiveReport) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, o := range objects {
+		r, size, modified, err := openEntry(ctx, st, o)
+		if err != nil {
+			return err
+		}
+		// a tar header needs the size up front, which is unknown for content GCS decompresses
+		if size < 0 {
+			var t tempReader
+			if t, size, err = spool(r); err != nil {
+				return err
+			}
+			r = t
+		}
+		err = tw.WriteHeader(&tar.Header{Name: entryName(o, strip), Typeflag: tar.TypeReg, Mode: 0644, Size: size,
+			ModTime: modified})
+		var n int64
+		if err == nil {
+			n, err = io.Copy(tw, r)
+		}
+		r.Close()
+		if err != nil {
+			return err
+		}
+		report.add(ArchiveEntry{Name: entryName(o, strip), Object: o, Bytes: n})
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// openEntry - a reader of name, with the size of its content (-1 if not known in advance) and modification time.
+// For a CStore these come from the single read request
+func openEntry(ctx context.Context, st ObjectStore, name string) (io.ReadCloser, int64, time.Time, error) {
+	if cs, ok := st.(*CStore); ok {
+		r, err := cs.openReader(ctx, name)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return r, r.Attrs.Size, r.Attrs.LastModified, nil
+	}
+	a, err := st.Attrs(ctx, name)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	r, size, err := st.NewReader(ctx, name)
+	return r, size, a.Updated, err
+}
+
+// tempReader - a temporary file, removed when closed
+type tempReader struct {
+	*os.File
+}
+
+func (t tempReader) Close() error {
+	err := t.File.Close()
+	_ = os.Remove(t.Name())
+	return err
+}
+
+// spool - copies r to a temporary file, returning a reader of the copy and its size. r is closed
+func spool(r io.ReadCloser) (tempReader, int64, error) {
+	defer r.Close()
+	tmp, err := ioutil.TempFile(``, `archive-`)
+	if err != nil {
+		return tempReader{}, 0, err
+	}
+	t := tempReader{tmp}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		t.Close()
+		return tempReader{}, 0, err
+	}
+	return t, n, nil
+}
+
+// ExtractArchive - writes each file within the archive object src to an object named destPrefix + entry name.
+// Entries that are absolute, or would escape destPrefix, stop the extraction with ErrUnsafePath, directories and
+// links are skipped. On error the report holds the objects already written
+func ExtractArchive(ctx context.Context, st ObjectStore, src string, destPrefix string, opts ExtractOptions) (*ArchiveReport, error) {
+	f, err := opts.Format.resolve(src)
+	if err != nil {
+		return nil, err
+	}
+	max := limit(opts.MaxBytes, defaultExtractBytes)
+	x := &extractor{st: st, prefix: destPrefix, remaining: max, limited: max > 0,
+		maxArchive: limit(opts.MaxArchiveBytes, defaultArchiveBytes), report: new(ArchiveReport)}
+	if f == ArchiveZip {
+		err = x.zip(ctx, src)
+	} else {
+		err = x.tarGz(ctx, src)
+	}
+	return x.report, err
+}
+
+// extractor - the state of an extraction
+type extractor struct {
+	st         ObjectStore
+	prefix     string
+	remaining  int64
+	limited    bool
+	maxArchive int64
+	report     *ArchiveReport
+}
+
+func (x *extractor) tarGz(ctx context.Context, src string) error {
+	r, _, err := x.st.NewReader(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err = x.write(ctx, h.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(ctx context.Context, src string) error {
+	r, size, err := x.st.NewReader(ctx, src)
+	if err != nil {
+		return err
+	}
+	if x.maxArchive > 0 {
+		if size > x.maxArchive {
+			r.Close()
+			return ErrArchiveTooLarge
+		}
+		// the size is unknown (-1) when the archive is decompressed as it is read
+		r = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, x.maxArchive+1), r}
+	}
+	tr, size, err := spool(r)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	if x.maxArchive > 0 && size > x.maxArchive {
+		return ErrArchiveTooLarge
+	}
+	zr, err := zip.NewReader(tr, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || !zf.Mode().IsRegular() {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = x.write(ctx, zf.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write - extracts a single entry
+func (x *extractor) write(ctx context.Context, entry string, r io.Reader) error {
+	n, err := safeEntryName(entry)
+	if err != nil {
+		return fmt.Errorf(`%w: %s`, err, entry)
+	}
+	if x.limited {
+		r = &limitedReader{r: r, remaining: &x.remaining}
+	}
+	name := x.prefix + n
+	var written int64
+	if sw, ok := x.st.(streamWriter); ok {
+		written, err = sw.WriteFrom(ctx, name, r, &WriteOptions{InferContentType: true})
+	} else {
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			written, err = int64(len(b)), x.st.Write(ctx, name, b, DetectContentType(name, b))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	x.report.add(ArchiveEntry{Name: entry, Object: name, Bytes: written})
+	return nil
+}
+
+// limitedReader - fails with ErrArchiveTooLarge once more than remaining bytes are read
+type limitedReader struct {
+	r         io.Reader
+	remaining *int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if *l.remaining -= int64(n); *l.remaining < 0 {
+		return n, ErrArchiveTooLarge
+	}
+	return n, err
+}
+
+// CreateArchive - see the package level CreateArchive
+func (cs *CStore) CreateArchive(ctx context.Context, dest string, objects []string, opts ArchiveOptions) (*ArchiveReport, error) {
+	return CreateArchive(ctx, cs, dest, objects, opts)
+}
+
+// ArchivePrefix - see the package level ArchivePrefix
+func (cs *CStore) ArchivePrefix(ctx context.Context, dest string, prefix string, opts ArchiveOptions) (*ArchiveReport, error) {
+	return ArchivePrefix(ctx, cs, dest, prefix, opts)
+}
+
+// ExtractArchive - see the package level ExtractArchive
+func (cs *CStore) ExtractArchive(ctx context.Context, src string, destPrefix string, opts ExtractOptions) (*ArchiveReport, error) {
+	return ExtractArchive(ctx, cs, src, destPrefix, opts)
+}
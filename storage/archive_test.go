@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`arc`)
+	files := map[string]string{`src/a.txt`: `aaa`, `src/sub/b.json`: `{"b":1}`, `src/sub/c.bin`: fileContents}
+	for n, c := range files {
+		_ = ms.Write(ctx, n, []byte(c), ``)
+	}
+	for _, dest := range []string{`out/src.zip`, `out/src.tar.gz`} {
+		r, err := ArchivePrefix(ctx, ms, dest, `src/`, ArchiveOptions{})
+		if err != nil {
+			t.Fatal(dest, err)
+		}
+		if len(r.Entries) != 3 || r.Entries[0].Name != `a.txt` || r.Bytes != int64(3+7+len(fileContents)) {
+			t.Errorf(`%s: unexpected report %+v`, dest, r)
+		}
+		x, err := ExtractArchive(ctx, ms, dest, `copy/`, ExtractOptions{})
+		if err != nil || len(x.Entries) != 3 {
+			t.Fatal(dest, err)
+		}
+		for n, c := range files {
+			if b, e := ReadObject(ctx, ms, `copy/`+n[len(`src/`):]); e != nil || string(b) != c {
+				t.Errorf(`%s: unexpected content for %s %v`, dest, n, e)
+			}
+		}
+		if _, err = ExtractArchive(ctx, ms, dest, `limited/`, ExtractOptions{MaxBytes: 20}); !errors.Is(err, ErrArchiveTooLarge) {
+			t.Errorf(`%s: expected ErrArchiveTooLarge, got %v`, dest, err)
+		}
+		if _, err = ExtractArchive(ctx, ms, dest, `unlimited/`, ExtractOptions{MaxBytes: -1}); err != nil {
+			t.Errorf(`%s: expected no limit, got %v`, dest, err)
+		}
+	}
+	// zip archives are copied to a temporary file, which is limited too
+	if _, err := ExtractArchive(ctx, ms, `out/src.zip`, `spooled/`, ExtractOptions{MaxArchiveBytes: 100}); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Error(`expected ErrArchiveTooLarge, got`, err)
+	}
+	if l, _ := ms.List(ctx, `spooled/`); len(l) != 0 {
+		t.Error(`expected nothing to be extracted from an archive over the limit`, len(l))
+	}
+	if _, err := CreateArchive(ctx, ms, `out/src.rar`, []string{`src/a.txt`}, ArchiveOptions{}); err == nil {
+		t.Error(`expected unknown format to fail`)
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`arc`)
+	for _, name := range []string{`../evil.txt`, `/etc/passwd`, `a/../../evil.txt`, `C:\evil.txt`} {
+		var zb bytes.Buffer
+		zw := zip.NewWriter(&zb)
+		w, _ := zw.Create(name)
+		_, _ = w.Write([]byte(`x`))
+		_ = zw.Close()
+		_ = ms.Write(ctx, `bad.zip`, zb.Bytes(), ``)
+
+		var tb bytes.Buffer
+		gz := gzip.NewWriter(&tb)
+		tw := tar.NewWriter(gz)
+		_ = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+		_, _ = tw.Write([]byte(`x`))
+		_ = tw.Close()
+		_ = gz.Close()
+		_ = ms.Write(ctx, `bad.tgz`, tb.Bytes(), ``)
+
+		for _, src := range []string{`bad.zip`, `bad.tgz`} {
+			if _, err := ExtractArchive(ctx, ms, src, `dest/`, ExtractOptions{}); !errors.Is(err, ErrUnsafePath) {
+				t.Errorf(`%s %s: expected ErrUnsafePath, got %v`, src, name, err)
+			}
+		}
+	}
+	if l, _ := ms.List(ctx, ``); len(l) != 2 {
+		t.Errorf(`expected nothing to be extracted, found %d objects`, len(l))
+	}
+	if n, err := safeEntryName(`a/./b/../c.txt`); err != nil || n != `a/c.txt` {
+		t.Error(`unexpected name`, n, err)
+	}
+}
+
+func Test_Archive(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	f := writeTestFiles(t)
+	defer deleteTestFiles(t, f)
+	dest := testPath + `archive/files.tar.gz`
+	if _, err := cs.CreateArchive(ctx, dest, f, ArchiveOptions{StripPrefix: testPath}); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.DeleteCloudFile(dest)
+	r, err := cs.ExtractArchive(ctx, dest, testPath+`extracted/`, ExtractOptions{})
+	if err != nil || len(r.Entries) != 2 {
+		t.Fatal(`extraction failed`, err)
+	}
+	for _, e := range r.Entries {
+		if b, e2 := ReadObject(ctx, cs, e.Object); e2 != nil || string(b) != fileContents {
+			t.Error(`unexpected content in`, e.Object, e2)
+		}
+		_ = cs.DeleteCloudFile(e.Object)
+	}
+}
+
+func Test_ArchiveGzipEncoded(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	fn := testPath + `archive/encoded.txt`
+	if err := cs.WriteCloudFileOpts(ctx, fn, []byte(fileContents), &WriteOptions{Gzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.DeleteCloudFile(fn)
+	for _, dest := range []string{testPath + `archive/encoded.tar.gz`, testPath + `archive/encoded.zip`} {
+		r, err := cs.CreateArchive(ctx, dest, []string{fn}, ArchiveOptions{StripPrefix: testPath})
+		if err != nil {
+			t.Fatal(dest, err)
+		}
+		if r.Bytes != int64(len(fileContents)) {
+			t.Error(`expected the decompressed size, got`, r.Bytes)
+		}
+		x, err := cs.ExtractArchive(ctx, dest, testPath+`extracted/`, ExtractOptions{})
+		if err != nil || len(x.Entries) != 1 {
+			t.Fatal(`extraction failed`, err)
+		}
+		if b, e := ReadObject(ctx, cs, x.Entries[0].Object); e != nil || string(b) != fileContents {
+			t.Error(`unexpected content`, string(b), e)
+		}
+		_ = cs.DeleteCloudFile(x.Entries[0].Object)
+		_ = cs.DeleteCloudFile(dest)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+/*
+	administration of the bucket accessed by a CStore: creation, configuration, IAM policy and deletion
+*/
+import (
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"google.golang.org/api/iterator"
+	"time"
+)
+
+// ErrBucketNotEmpty - returned by DeleteBucket when the bucket still holds objects (including noncurrent versions)
+var ErrBucketNotEmpty = errors.New(`storage: bucket is not empty`)
+
+// BucketOptions - settings for a new bucket, zero values are left to the GCS defaults
+type BucketOptions struct {
+	// Location - e.g. US, EU or a region such as us-central1
+	Location string
+	// StorageClass - default class for new objects, e.g. STANDARD, NEARLINE, COLDLINE, ARCHIVE
+	StorageClass  string
+	Versioning    bool
+	UniformAccess bool
+	Labels        map[string]string
+	// RetentionPeriod - minimum time objects must be kept, zero for none
+	RetentionPeriod time.Duration
+	CORS            []storage.CORS
+	Lifecycle       storage.Lifecycle
+}
+
+// CreateBucket - creates the bucket this store refers to, within projectID
+func (cs *CStore) CreateBucket(ctx context.Context, projectID string, opts BucketOptions) error {
+	if len(projectID) == 0 {
+		return errors.New(`invalid parameter(s)`)
+	}
+	attrs := &storage.BucketAttrs{
+		Location:                 opts.Location,
+		StorageClass:             opts.StorageClass,
+		VersioningEnabled:        opts.Versioning,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: opts.UniformAccess},
+		Labels:                   opts.Labels,
+		CORS:                     opts.CORS,
+		Lifecycle:                opts.Lifecycle,
+	}
+	if opts.RetentionPeriod > 0 {
+		attrs.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: opts.RetentionPeriod}
+	}
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	return classify(``, cs.bucket.Create(ctx, projectID, attrs))
+}
+
+// BucketExists - returns true if the bucket can be found, any error other than ErrNotFound is returned
+func (cs *CStore) BucketExists(ctx context.Context) (bool, error) {
+	_, err := cs.BucketAttrs(ctx)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// BucketAttrs - the current configuration of the bucket
+func (cs *CStore) BucketAttrs(ctx context.Context) (*storage.BucketAttrs, error) {
+	var a *storage.BucketAttrs
+	err := cs.retry(ctx, ``, func(ctx context.Context) error {
+		var err error
+		a, err = cs.bucket.Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// UpdateBucket - patch the bucket configuration, only the fields set in ua are changed
+func (cs *CStore) UpdateBucket(ctx context.Context, ua storage.BucketAttrsToUpdate) (*storage.BucketAttrs, error) {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	a, err := cs.bucket.Update(ctx, ua)
+	return a, classify(``, err)
+}
+
+// SetVersioning - turn object versioning on or off
+func (cs *CStore) SetVersioning(ctx context.Context, enabled bool) error {
+	_, err := cs.UpdateBucket(ctx, storage.BucketAttrsToUpdate{VersioningEnabled: enabled})
+	return err
+}
+
+// SetLabels - adds or replaces the given labels, a label with an empty value is removed
+func (cs *CStore) SetLabels(ctx context.Context, labels map[string]string) error {
+	var ua storage.BucketAttrsToUpdate
+	for k, v := range labels {
+		if len(v) == 0 {
+			ua.DeleteLabel(k)
+		} else {
+			ua.SetLabel(k, v)
+		}
+	}
+	_, err := cs.UpdateBucket(ctx, ua)
+	return err
+}
+
+// GetCORS - the bucket's cross origin resource sharing configuration
+func (cs *CStore) GetCORS(ctx context.Context) ([]storage.CORS, error) {
+	a, err := cs.BucketAttrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.CORS, nil
+}
+
+// SetCORS - replaces the bucket's cross origin resource sharing configuration, an empty slice removes it
+func (cs *CStore) SetCORS(ctx context.Context, cors []storage.CORS) error {
+	if cors == nil {
+		cors = []storage.CORS{}
+	}
+	_, err := cs.UpdateBucket(ctx, storage.BucketAttrsToUpdate{CORS: cors})
+	return err
+}
+
+// GetRetentionPolicy - the bucket's retention policy, nil if there is none
+func (cs *CStore) GetRetentionPolicy(ctx context.Context) (*storage.RetentionPolicy, error) {
+	a, err := cs.BucketAttrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.RetentionPolicy, nil
+}
+
+// SetRetentionPeriod - objects cannot be deleted or replaced until they are this old, zero removes the policy.
+// Fails once the policy has been locked
+func (cs *CStore) SetRetentionPeriod(ctx context.Context, period time.Duration) error {
+	_, err := cs.UpdateBucket(ctx, storage.BucketAttrsToUpdate{RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: period}})
+	return err
+}
+
+// LockRetentionPolicy - permanently locks the retention policy, it can then only be increased. This cannot be undone
+func (cs *CStore) LockRetentionPolicy(ctx context.Context) error {
+	a, err := cs.BucketAttrs(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	return classify(``, cs.bucket.If(storage.BucketConditions{MetagenerationMatch: a.MetaGeneration}).LockRetentionPolicy(ctx))
+}
+
+// GetIAMPolicy - the bucket's IAM policy
+func (cs *CStore) GetIAMPolicy(ctx context.Context) (*iam.Policy, error) {
+	var p *iam.Policy
+	err := cs.retry(ctx, ``, func(ctx context.Context) error {
+		var err error
+		p, err = cs.bucket.IAM().Policy(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetIAMPolicy - replaces the bucket's IAM policy. p should be obtained from GetIAMPolicy and then modified,
+// the update fails if the policy has been changed in the meantime
+func (cs *CStore) SetIAMPolicy(ctx context.Context, p *iam.Policy) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	return classify(``, cs.bucket.IAM().SetPolicy(ctx, p))
+}
+
+// AddIAMMember - grants role (e.g. roles/storage.objectViewer) to member (e.g. serviceAccount:x@y.iam.gserviceaccount.com)
+func (cs *CStore) AddIAMMember(ctx context.Context, role string, member string) error {
+	p, err := cs.GetIAMPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	if p.HasRole(member, iam.RoleName(role)) {
+		return nil
+	}
+	p.Add(member, iam.RoleName(role))
+	return cs.SetIAMPolicy(ctx, p)
+}
+
+// RemoveIAMMember - revokes role from member
+func (cs *CStore) RemoveIAMMember(ctx context.Context, role string, member string) error {
+	p, err := cs.GetIAMPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	if !p.HasRole(member, iam.RoleName(role)) {
+		return nil
+	}
+	p.Remove(member, iam.RoleName(role))
+	return cs.SetIAMPolicy(ctx, p)
+}
+
+// DeleteBucket - deletes the bucket, which must be empty (ErrBucketNotEmpty is returned otherwise)
+func (cs *CStore) DeleteBucket(ctx context.Context) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	it := cs.bucket.Objects(ctx, &storage.Query{Versions: true})
+	if _, err := it.Next(); err != iterator.Done {
+		if err == nil {
+			return ErrBucketNotEmpty
+		}
+		return classify(``, err)
+	}
+	return classify(``, cs.bucket.Delete(ctx))
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"github.com/cambefus/gcp_go_utils/secrets"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_BucketAdmin(t *testing.T) {
+	requireGCP(t)
+	setup(t)
+	s, e := secrets.InitializeFromEnvironment(`utilities_config`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cr, e := s.GetFile(`STORAGE_CREDENTIALS`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx := context.Background()
+	name := cs.BucketName() + `-admin-` + strconv.FormatInt(time.Now().Unix(), 36)
+	b, e := NewCStore(cr, name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ok, _ := b.BucketExists(ctx); ok {
+		t.Fatal(`bucket should not exist yet`)
+	}
+	e = b.CreateBucket(ctx, s.GetString(`PROJECT_ID`), BucketOptions{
+		Location:      `US`,
+		Versioning:    true,
+		UniformAccess: true,
+		Labels:        map[string]string{`purpose`: `testing`},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if e := b.DeleteBucket(ctx); e != nil {
+			t.Error(e)
+		}
+	}()
+
+	a, e := b.BucketAttrs(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !a.VersioningEnabled || !a.UniformBucketLevelAccess.Enabled || a.Labels[`purpose`] != `testing` {
+		t.Errorf(`unexpected bucket attributes %+v`, a)
+	}
+
+	cors := []storage.CORS{{Origins: []string{`https://example.com`}, Methods: []string{`GET`}, MaxAge: time.Hour}}
+	if e = b.SetCORS(ctx, cors); e != nil {
+		t.Error(e)
+	}
+	if c, _ := b.GetCORS(ctx); len(c) != 1 || c[0].Origins[0] != `https://example.com` {
+		t.Errorf(`unexpected CORS %+v`, c)
+	}
+	if e = b.SetLabels(ctx, map[string]string{`purpose`: ``, `team`: `utils`}); e != nil {
+		t.Error(e)
+	}
+	if e = b.SetRetentionPeriod(ctx, time.Hour); e != nil {
+		t.Error(e)
+	}
+	if rp, _ := b.GetRetentionPolicy(ctx); rp == nil || rp.RetentionPeriod != time.Hour {
+		t.Errorf(`unexpected retention policy %+v`, rp)
+	}
+	if e = b.SetRetentionPeriod(ctx, 0); e != nil {
+		t.Error(e)
+	}
+	if p, e := b.GetIAMPolicy(ctx); e != nil || len(p.Roles()) == 0 {
+		t.Error(`expected IAM policy`, e)
+	}
+
+	if e = b.WriteFile(`x.txt`, fileContents); e != nil {
+		t.Fatal(e)
+	}
+	if e = b.DeleteBucket(ctx); e != ErrBucketNotEmpty {
+		t.Error(`expected ErrBucketNotEmpty, got`, e)
+	}
+	if e = b.DeleteCloudFile(`x.txt`); e != nil {
+		t.Error(e)
+	}
+	// with versioning on, the deleted object remains as a noncurrent version
+	if e = b.SetVersioning(ctx, false); e != nil {
+		t.Error(e)
+	}
+	l, _ := b.ListAll(ctx, ListOptions{})
+	for _, oa := range l.Objects {
+		_ = b.DeleteCloudFile(oa.Name)
+	}
+	l, _ = b.ListAll(ctx, ListOptions{Versions: true})
+	for _, oa := range l.Objects {
+		_ = b.DeleteVersion(ctx, oa.Name, oa.Generation)
+	}
+}
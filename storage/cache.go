@@ -0,0 +1,382 @@
+package storage
+
+/*
+	read-through cache of object content
+	entries are held in memory, or in files within a local directory, and evicted least recently used first once the
+	size limit is reached. A cached entry is served without checking GCS until its TTL expires, after which its
+	generation & metageneration (and etag, where the store reports one when read) are compared with the object
+	before it is served again
+*/
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheBytes = 64 << 20
+	cacheTempPrefix   = `.tmp-`
+)
+
+// CacheOptions - limits of a ReadCache, zero values use the defaults
+type CacheOptions struct {
+	MaxBytes       int64         // total size of cached content, defaults to 64MiB
+	MaxObjectBytes int64         // larger objects are read directly, defaults to a quarter of MaxBytes
+	TTL            time.Duration // how long an entry is served before being revalidated, zero to validate every read
+	Dir            string        // if set, content is cached in files within Dir rather than in memory. Dir should not be shared
+}
+
+// CacheStats - activity of a ReadCache
+type CacheStats struct {
+	Hits        int64 // reads served from the cache
+	Misses      int64 // reads of content from the store
+	Validations int64 // checks of cached entries against the store
+	Evictions   int64 // entries removed to keep within MaxBytes
+	Entries     int
+	Bytes       int64
+}
+
+// cacheEntry - the cached content of a generation of an object
+type cacheEntry struct {
+	name           string
+	generation     int64
+	metageneration int64
+	etag           string
+	size           int64
+	content        []byte // when memory backed
+	file           string // when disk backed
+	validated      time.Time
+	elem           *list.Element
+}
+
+// cacheFetch - reads of an object from the store in progress, and the invalidations of it made meanwhile
+type cacheFetch struct {
+	n             int
+	invalidations int
+}
+
+// ReadCache - an ObjectStore that caches content read from another store. Writes, deletes and copies through
+// the cache invalidate the entries affected, changes made elsewhere are detected by validation
+type ReadCache struct {
+	store   ObjectStore
+	opts    CacheOptions
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	fetches map[string]*cacheFetch
+	lru     *list.List // most recently used at the front
+	stats   CacheStats
+}
+
+// NewReadCache - a cache in front of st. Cache files left in opts.Dir by an earlier process are removed,
+// as their generations are unknown
+func NewReadCache(st ObjectStore, opts CacheOptions) (*ReadCache, error) {
+	if st == nil {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultCacheBytes
+	}
+	if opts.MaxObjectBytes <= 0 || opts.MaxObjectBytes > opts.MaxBytes {
+		opts.MaxObjectBytes = opts.MaxBytes / 4
+	}
+	if len(opts.Dir) > 0 {
+		if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := cleanCacheDir(opts.Dir); err != nil {
+			return nil, err
+		}
+	}
+	return &ReadCache{store: st, opts: opts, entries: map[string]*cacheEntry{}, fetches: map[string]*cacheFetch{},
+		lru: list.New()}, nil
+}
+
+// NewReadCache - a cache in front of this store
+func (cs *CStore) NewReadCache(opts CacheOptions) (*ReadCache, error) {
+	return NewReadCache(cs, opts)
+}
+
+// Stats - a snapshot of the cache activity
+func (rc *ReadCache) Stats() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	s := rc.stats
+	s.Entries = len(rc.entries)
+	return s
+}
+
+// GetFileReader - as CStore.GetFileReader, served from the cache where possible
+func (rc *ReadCache) GetFileReader(fn string) (io.ReadCloser, int64, error) {
+	return rc.NewReader(context.Background(), fn)
+}
+
+// NewReader - ObjectStore implementation, served from the cache where possible
+func (rc *ReadCache) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	rc.mu.Lock()
+	e, ok := rc.entries[name]
+	if ok && rc.opts.TTL > 0 && time.Since(e.validated) < rc.opts.TTL {
+		r, err := rc.open(e)
+		rc.mu.Unlock()
+		if err == nil {
+			return r, e.size, nil
+		}
+		rc.Invalidate(name)
+		return rc.fetch(ctx, name)
+	}
+	rc.mu.Unlock()
+	if !ok {
+		return rc.fetch(ctx, name)
+	}
+
+	a, err := rc.store.Attrs(ctx, name)
+	rc.mu.Lock()
+	rc.stats.Validations++
+	rc.mu.Unlock()
+	if err != nil {
+		rc.Invalidate(name)
+		return nil, 0, err
+	}
+	rc.mu.Lock()
+	if cur, ok := rc.entries[name]; ok && cur.matches(a) {
+		cur.validated = time.Now()
+		r, err := rc.open(cur)
+		rc.mu.Unlock()
+		if err == nil {
+			return r, cur.size, nil
+		}
+	} else {
+		rc.mu.Unlock()
+	}
+	rc.Invalidate(name)
+	return rc.fetch(ctx, name)
+}
+
+// open - a reader of the cached content, counted as a hit. Must be called with the lock held
+func (rc *ReadCache) open(e *cacheEntry) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	if len(e.file) > 0 {
+		f, err := os.Open(e.file)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	} else {
+		r = ioutil.NopCloser(bytes.NewReader(e.content))
+	}
+	rc.lru.MoveToFront(e.elem)
+	rc.stats.Hits++
+	return r, nil
+}
+
+// fetch - reads the object from the store, caching it if it is small enough. Content is not cached if the object
+// is invalidated during the read, as it may predate a write made through the cache
+func (rc *ReadCache) fetch(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	rc.mu.Lock()
+	rc.stats.Misses++
+	f, ok := rc.fetches[name]
+	if !ok {
+		f = &cacheFetch{}
+		rc.fetches[name] = f
+	}
+	f.n++
+	seen := f.invalidations
+	rc.mu.Unlock()
+	defer func() {
+		rc.mu.Lock()
+		if f.n--; f.n == 0 {
+			delete(rc.fetches, name)
+		}
+		rc.mu.Unlock()
+	}()
+	e := &cacheEntry{name: name}
+	var r io.ReadCloser
+	var size int64
+	// a CStore reader reports the generation read (but not the etag), so the object is read with a single request
+	if cs, ok := rc.store.(*CStore); ok {
+		sr, err := cs.openReader(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, size, e.generation, e.metageneration = sr, sr.Attrs.Size, sr.Attrs.Generation, sr.Attrs.Metageneration
+	} else {
+		a, err := rc.store.Attrs(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if r, size, err = rc.store.NewReader(ctx, name); err != nil {
+			return nil, 0, err
+		}
+		e.generation, e.metageneration, e.etag = a.Generation, a.Metageneration, a.Etag
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, rc.opts.MaxObjectBytes+1))
+	if err != nil {
+		r.Close()
+		return nil, 0, classify(name, err)
+	}
+	// too large to cache, the remainder is read directly
+	if int64(len(b)) > rc.opts.MaxObjectBytes {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r), r}, size, nil
+	}
+	r.Close()
+	e.size, e.validated = int64(len(b)), time.Now()
+	rc.add(e, b, func() bool { return f.invalidations == seen })
+	return ioutil.NopCloser(bytes.NewReader(b)), e.size, nil
+}
+
+// matches - true if a describes the generation (and metageneration) cached as e
+func (e *cacheEntry) matches(a *storage.ObjectAttrs) bool {
+	return e.generation == a.Generation && e.metageneration == a.Metageneration && (len(e.etag) == 0 || e.etag == a.Etag)
+}
+
+// add - caches content as the entry e, evicting others as needed. Nothing is cached unless current, which is
+// called with the lock held, returns true
+func (rc *ReadCache) add(e *cacheEntry, content []byte, current func() bool) {
+	if e.size > rc.opts.MaxObjectBytes {
+		return
+	}
+	if len(rc.opts.Dir) > 0 {
+		sum := sha256.Sum256([]byte(e.name))
+		e.file = filepath.Join(rc.opts.Dir, hex.EncodeToString(sum[:]))
+		tmp, err := ioutil.TempFile(rc.opts.Dir, cacheTempPrefix)
+		if err != nil {
+			return
+		}
+		_, err = tmp.Write(content)
+		if e2 := tmp.Close(); err == nil {
+			err = e2
+		}
+		if err == nil {
+			rc.mu.Lock()
+			defer rc.mu.Unlock()
+			if !current() {
+				_ = os.Remove(tmp.Name())
+				return
+			}
+			rc.remove(e.name)
+			err = os.Rename(tmp.Name(), e.file)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+			return
+		}
+	} else {
+		e.content = content
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if !current() {
+			return
+		}
+		rc.remove(e.name)
+	}
+	e.elem = rc.lru.PushFront(e)
+	rc.entries[e.name] = e
+	rc.stats.Bytes += e.size
+	for rc.stats.Bytes > rc.opts.MaxBytes {
+		oldest := rc.lru.Back().Value.(*cacheEntry)
+		rc.remove(oldest.name)
+		rc.stats.Evictions++
+	}
+}
+
+// remove - drops the entry for name. Must be called with the lock held
+func (rc *ReadCache) remove(name string) {
+	e, ok := rc.entries[name]
+	if !ok {
+		return
+	}
+	delete(rc.entries, name)
+	rc.lru.Remove(e.elem)
+	rc.stats.Bytes -= e.size
+	if len(e.file) > 0 {
+		_ = os.Remove(e.file)
+	}
+}
+
+// cleanCacheDir - removes the cache files (and any incomplete temporary files) within dir, other files are left alone
+func cleanCacheDir(dir string) error {
+	fl, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fl {
+		n := fi.Name()
+		if _, err := hex.DecodeString(n); (err == nil && len(n) == 2*sha256.Size) || strings.HasPrefix(n, cacheTempPrefix) {
+			if err = os.Remove(filepath.Join(dir, n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Invalidate - drops any cached content for name, including content being read from the store
+func (rc *ReadCache) Invalidate(name string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.remove(name)
+	if f, ok := rc.fetches[name]; ok {
+		f.invalidations++
+	}
+}
+
+// Purge - drops all cached content
+func (rc *ReadCache) Purge() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for n := range rc.entries {
+		rc.remove(n)
+	}
+	for _, f := range rc.fetches {
+		f.invalidations++
+	}
+}
+
+// List - ObjectStore implementation
+func (rc *ReadCache) List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error) {
+	return rc.store.List(ctx, prefix)
+}
+
+// Attrs - ObjectStore implementation
+func (rc *ReadCache) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	return rc.store.Attrs(ctx, name)
+}
+
+// Write - ObjectStore implementation
+func (rc *ReadCache) Write(ctx context.Context, name string, content []byte, contentType string) error {
+	defer rc.Invalidate(name)
+	return rc.store.Write(ctx, name, content, contentType)
+}
+
+// Delete - ObjectStore implementation
+func (rc *ReadCache) Delete(ctx context.Context, name string) error {
+	defer rc.Invalidate(name)
+	return rc.store.Delete(ctx, name)
+}
+
+// Copy - ObjectStore implementation
+func (rc *ReadCache) Copy(ctx context.Context, src string, dest ObjectStore, destName string) error {
+	if d, ok := dest.(*ReadCache); ok {
+		defer d.Invalidate(destName)
+		dest = d.store
+	}
+	return rc.store.Copy(ctx, src, dest, destName)
+}
+
+// SignedURL - ObjectStore implementation
+func (rc *ReadCache) SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error) {
+	return rc.store.SignedURL(ctx, name, method, expires)
+}
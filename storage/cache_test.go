@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/storagetest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readCached(t *testing.T, rc *ReadCache, name string) string {
+	t.Helper()
+	r, _, e := rc.NewReader(context.Background(), name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Close()
+	b, e := ioutil.ReadAll(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return string(b)
+}
+
+func TestReadCache(t *testing.T) {
+	for _, dir := range []string{``, t.TempDir()} {
+		ms := NewMemStore(`cache`)
+		ctx := context.Background()
+		rc, e := NewReadCache(ms, CacheOptions{MaxBytes: 10, MaxObjectBytes: 6, Dir: dir})
+		if e != nil {
+			t.Fatal(e)
+		}
+		_ = ms.Write(ctx, `a`, []byte(`aaaa`), ``)
+		_ = ms.Write(ctx, `b`, []byte(`bbbb`), ``)
+		_ = ms.Write(ctx, `big`, []byte(`0123456789`), ``)
+
+		if s := readCached(t, rc, `a`); s != `aaaa` {
+			t.Error(`unexpected content`, s)
+		}
+		if s := readCached(t, rc, `a`); s != `aaaa` {
+			t.Error(`unexpected content`, s)
+		}
+		if st := rc.Stats(); st.Hits != 1 || st.Misses != 1 || st.Validations != 1 || st.Bytes != 4 {
+			t.Errorf(`unexpected stats %+v`, st)
+		}
+
+		// a change made directly to the store is detected by validation
+		_ = ms.Write(ctx, `a`, []byte(`AAAA`), ``)
+		if s := readCached(t, rc, `a`); s != `AAAA` {
+			t.Error(`expected new generation, got`, s)
+		}
+
+		// objects over MaxObjectBytes are not cached
+		if s := readCached(t, rc, `big`); s != `0123456789` {
+			t.Error(`unexpected content`, s)
+		}
+		if st := rc.Stats(); st.Entries != 1 {
+			t.Errorf(`unexpected stats %+v`, st)
+		}
+
+		// the least recently used entry is evicted
+		_ = ms.Write(ctx, `c`, []byte(`cccc`), ``)
+		readCached(t, rc, `b`)
+		readCached(t, rc, `a`)
+		readCached(t, rc, `c`)
+		if st := rc.Stats(); st.Evictions != 1 || st.Entries != 2 || st.Bytes != 8 {
+			t.Errorf(`unexpected stats %+v`, st)
+		}
+		if _, ok := rc.entries[`b`]; ok {
+			t.Error(`expected b to be evicted`)
+		}
+
+		// writes and deletes through the cache invalidate it
+		if e = rc.Write(ctx, `a`, []byte(`xx`), ``); e != nil {
+			t.Fatal(e)
+		}
+		if s := readCached(t, rc, `a`); s != `xx` {
+			t.Error(`unexpected content`, s)
+		}
+		if e = rc.Delete(ctx, `a`); e != nil {
+			t.Fatal(e)
+		}
+		if _, _, e = rc.NewReader(ctx, `a`); !errors.Is(e, ErrNotFound) {
+			t.Error(`expected ErrNotFound, got`, e)
+		}
+
+		rc.Purge()
+		if st := rc.Stats(); st.Entries != 0 || st.Bytes != 0 {
+			t.Errorf(`unexpected stats %+v`, st)
+		}
+		if len(dir) > 0 {
+			if fl, _ := ioutil.ReadDir(dir); len(fl) != 0 {
+				t.Error(`expected cache files to be removed`, len(fl))
+			}
+		}
+	}
+}
+
+func TestReadCacheTTL(t *testing.T) {
+	ms := NewMemStore(`cache`)
+	ctx := context.Background()
+	rc, _ := NewReadCache(ms, CacheOptions{TTL: time.Hour})
+	_ = ms.Write(ctx, `a`, []byte(`aaaa`), ``)
+	readCached(t, rc, `a`)
+	_ = ms.Write(ctx, `a`, []byte(`AAAA`), ``)
+	// within the TTL the cached content is served without validation
+	if s := readCached(t, rc, `a`); s != `aaaa` {
+		t.Error(`expected cached content, got`, s)
+	}
+	if st := rc.Stats(); st.Hits != 1 || st.Validations != 0 {
+		t.Errorf(`unexpected stats %+v`, st)
+	}
+	rc.Invalidate(`a`)
+	if s := readCached(t, rc, `a`); s != `AAAA` {
+		t.Error(`unexpected content`, s)
+	}
+}
+
+// hookStore - calls afterRead once an object has been opened for reading
+type hookStore struct {
+	ObjectStore
+	afterRead func()
+}
+
+func (hs *hookStore) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	r, n, err := hs.ObjectStore.NewReader(ctx, name)
+	if hs.afterRead != nil {
+		hs.afterRead()
+	}
+	return r, n, err
+}
+
+func TestReadCacheConcurrentWrite(t *testing.T) {
+	for _, dir := range []string{``, t.TempDir()} {
+		ms := NewMemStore(`cache`)
+		ctx := context.Background()
+		hs := &hookStore{ObjectStore: ms}
+		rc, _ := NewReadCache(hs, CacheOptions{TTL: time.Hour, Dir: dir})
+		_ = ms.Write(ctx, `a`, []byte(`old`), ``)
+		// the write through the cache completes while the old content is being read
+		hs.afterRead = func() {
+			hs.afterRead = nil
+			if e := rc.Write(ctx, `a`, []byte(`new`), ``); e != nil {
+				t.Error(e)
+			}
+		}
+		if s := readCached(t, rc, `a`); s != `old` {
+			t.Error(`unexpected content`, s)
+		}
+		if s := readCached(t, rc, `a`); s != `new` {
+			t.Error(`expected the write to invalidate the read in progress, got`, s)
+		}
+		if len(rc.fetches) != 0 {
+			t.Error(`expected no fetches in progress`, len(rc.fetches))
+		}
+	}
+}
+
+func Test_ReadCache(t *testing.T) {
+	setup(t)
+	fn := testPath + `cached.txt`
+	if e := cs.WriteFile(fn, fileContents); e != nil {
+		t.Fatal(e)
+	}
+	defer cs.DeleteCloudFile(fn)
+	rc, e := cs.NewReadCache(CacheOptions{Dir: t.TempDir()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 3; i++ {
+		r, n, e := rc.GetFileReader(fn)
+		if e != nil {
+			t.Fatal(e)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != fileContents || n != int64(len(fileContents)) {
+			t.Error(`unexpected content`, string(b), n)
+		}
+	}
+	if e = cs.WriteFile(fn, `changed`); e != nil {
+		t.Fatal(e)
+	}
+	r, _, e := rc.GetFileReader(fn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != `changed` {
+		t.Error(`expected new generation, got`, string(b))
+	}
+	if st := rc.Stats(); st.Hits != 2 || st.Misses != 2 {
+		t.Errorf(`unexpected stats %+v`, st)
+	}
+}
+
+func TestReadCacheCleansDir(t *testing.T) {
+	dir := t.TempDir()
+	ms := NewMemStore(`cache`)
+	ctx := context.Background()
+	_ = ms.Write(ctx, `a`, []byte(`aaaa`), ``)
+	rc, _ := NewReadCache(ms, CacheOptions{Dir: dir})
+	readCached(t, rc, `a`)
+	other := filepath.Join(dir, `keep.txt`)
+	_ = ioutil.WriteFile(other, []byte(`x`), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, cacheTempPrefix+`1`), []byte(`x`), 0644)
+
+	// a new process starts with an empty cache, files left by the last are removed
+	if _, e := NewReadCache(ms, CacheOptions{Dir: dir}); e != nil {
+		t.Fatal(e)
+	}
+	fl, _ := ioutil.ReadDir(dir)
+	if len(fl) != 1 || fl[0].Name() != `keep.txt` {
+		t.Error(`expected only keep.txt to remain`, fl)
+	}
+	if _, e := os.Stat(other); e != nil {
+		t.Error(e)
+	}
+}
+
+// countingTransport - counts the requests made
+type countingTransport struct {
+	n    int64
+	base http.RoundTripper
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&ct.n, 1)
+	return ct.base.RoundTrip(r)
+}
+
+func Test_ReadCacheRequests(t *testing.T) {
+	srv := storagetest.NewServer(`cached`)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	ct := &countingTransport{base: emulatorTransport{host: u.Host, base: http.DefaultTransport}}
+	ctx := context.Background()
+	st, e := NewCStoreWith(ctx, `cached`, WithEmulator(srv.URL), WithHTTPClient(&http.Client{Transport: ct}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer st.Close()
+	if e = st.WriteFile(`a.txt`, fileContents); e != nil {
+		t.Fatal(e)
+	}
+	rc, _ := st.NewReadCache(CacheOptions{})
+	atomic.StoreInt64(&ct.n, 0)
+	if s := readCached(t, rc, `a.txt`); s != fileContents {
+		t.Error(`unexpected content`, s)
+	}
+	if n := atomic.LoadInt64(&ct.n); n != 1 {
+		t.Error(`expected a single request for a miss, got`, n)
+	}
+	atomic.StoreInt64(&ct.n, 0)
+	readCached(t, rc, `a.txt`)
+	if n := atomic.LoadInt64(&ct.n); n != 1 {
+		t.Error(`expected a single request to validate, got`, n)
+	}
+	if st := rc.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf(`unexpected stats %+v`, st)
+	}
+	// a metadata only update is detected, as the metageneration changes
+	if _, e = st.UpdateAttrs(ctx, `a.txt`, storage.ObjectAttrsToUpdate{Metadata: map[string]string{`k`: `v`}}); e != nil {
+		t.Fatal(e)
+	}
+	readCached(t, rc, `a.txt`)
+	if st := rc.Stats(); st.Hits != 1 || st.Misses != 2 {
+		t.Errorf(`unexpected stats %+v`, st)
+	}
+}
@@ -0,0 +1,181 @@
+package storage
+
+/*
+	construction of CStores with explicit client configuration
+	each store owns the client it creates, which is released by Close. A client may be shared between stores
+	by creating it once and passing it with WithClient, in which case the caller remains responsible for closing it
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"google.golang.org/api/option"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// clientConfig - the settings collected from ClientOptions
+type clientConfig struct {
+	client      *storage.Client
+	credentials []byte
+	userProject string
+	endpoint    string
+	options     []option.ClientOption
+}
+
+// ClientOption - configures the client used by a CStore, see NewCStoreWith
+type ClientOption func(*clientConfig) error
+
+// WithCredentialsJSON - service account JSON credentials, also used to sign urls (see SetSigner)
+func WithCredentialsJSON(cred []byte) ClientOption {
+	return func(c *clientConfig) error {
+		if len(cred) == 0 {
+			return errors.New(`invalid parameter(s)`)
+		}
+		c.credentials = cred
+		c.options = append(c.options, option.WithCredentialsJSON(cred))
+		return nil
+	}
+}
+
+// WithCredentialsFile - a file holding service account JSON credentials
+func WithCredentialsFile(path string) ClientOption {
+	return func(c *clientConfig) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return WithCredentialsJSON(b)(c)
+	}
+}
+
+// WithEndpoint - the base url of the storage api, for private endpoints or an emulator
+func WithEndpoint(url string) ClientOption {
+	return func(c *clientConfig) error {
+		c.endpoint = url
+		c.options = append(c.options, option.WithEndpoint(url))
+		return nil
+	}
+}
+
+// WithoutAuthentication - anonymous requests, for public buckets or emulators
+func WithoutAuthentication() ClientOption {
+	return func(c *clientConfig) error {
+		c.options = append(c.options, option.WithoutAuthentication())
+		return nil
+	}
+}
+
+// WithEmulator - targets a storage emulator (such as fake-gcs-server, or storagetest.Server) at baseURL,
+// e.g. http://localhost:4443, using anonymous credentials
+func WithEmulator(baseURL string) ClientOption {
+	return func(c *clientConfig) error {
+		u, err := url.Parse(baseURL)
+		if err != nil || len(u.Host) == 0 {
+			return errors.New(`invalid emulator url: ` + baseURL)
+		}
+		// the client reads object content from the endpoint host using https, an http emulator needs the scheme changed
+		var rt http.RoundTripper = http.DefaultTransport
+		if u.Scheme == `http` {
+			rt = emulatorTransport{host: u.Host, base: rt}
+		}
+		c.endpoint = strings.TrimSuffix(baseURL, `/`) + `/storage/v1/`
+		c.options = append(c.options, option.WithEndpoint(c.endpoint), option.WithHTTPClient(&http.Client{Transport: rt}))
+		return nil
+	}
+}
+
+// emulatorTransport - sends requests for host over http
+type emulatorTransport struct {
+	host string
+	base http.RoundTripper
+}
+
+func (t emulatorTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == `https` && r.URL.Host == t.host {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = `http`
+	}
+	return t.base.RoundTrip(r)
+}
+
+// WithUserProject - the project billed for requests, required for requester pays buckets
+func WithUserProject(projectID string) ClientOption {
+	return func(c *clientConfig) error {
+		c.userProject = projectID
+		return nil
+	}
+}
+
+// WithHTTPClient - the http client used for requests, it must supply any authentication required
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *clientConfig) error {
+		c.options = append(c.options, option.WithHTTPClient(hc))
+		return nil
+	}
+}
+
+// WithClientOptions - any other options supported by the storage client
+func WithClientOptions(opts ...option.ClientOption) ClientOption {
+	return func(c *clientConfig) error {
+		c.options = append(c.options, opts...)
+		return nil
+	}
+}
+
+// WithClient - use an existing client, shared with other stores. It is not closed by Close,
+// other options configuring the client are ignored
+func WithClient(client *storage.Client) ClientOption {
+	return func(c *clientConfig) error {
+		if client == nil {
+			return errors.New(`invalid parameter(s)`)
+		}
+		c.client = client
+		return nil
+	}
+}
+
+// NewCStoreWith - creates a store for bucketName using a client configured by opts. Without credentials options
+// the application default credentials are used (or, as for any client, the emulator given by the
+// STORAGE_EMULATOR_HOST environment variable). Close releases the client
+func NewCStoreWith(ctx context.Context, bucketName string, opts ...ClientOption) (*CStore, error) {
+	if len(bucketName) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	var cfg clientConfig
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	this := &CStore{client: cfg.client, credentials: cfg.credentials, retryPolicy: DefaultRetryPolicy,
+		options: cfg.options, userProject: cfg.userProject, endpoint: cfg.endpoint}
+	if this.client == nil {
+		var err error
+		if this.client, err = storage.NewClient(ctx, cfg.options...); err != nil {
+			return nil, err
+		}
+		this.ownsClient = true
+	}
+	this.bucket = this.client.Bucket(bucketName)
+	if len(cfg.userProject) > 0 {
+		this.bucket = this.bucket.UserProject(cfg.userProject)
+	}
+	return this, nil
+}
+
+// Client - the underlying storage client
+func (cs *CStore) Client() *storage.Client {
+	return cs.client
+}
+
+// Close - releases the client, unless it was supplied by WithClient. The store must not be used afterwards
+func (cs *CStore) Close() error {
+	if !cs.ownsClient || cs.client == nil {
+		return nil
+	}
+	cs.ownsClient = false
+	return cs.client.Close()
+}
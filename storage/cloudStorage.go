@@ -8,12 +8,13 @@ import (
 	"cloud.google.com/go/storage"
 	"context"
 	"errors"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,61 +22,82 @@ type CStore struct {
 	client      *storage.Client
 	bucket      *storage.BucketHandle
 	credentials []byte
+	signer      Signer
+	timeout     time.Duration
+	key         []byte
+	retryPolicy RetryPolicy
+	ownsClient  bool
+	options     []option.ClientOption
+	userProject string
+	endpoint    string
+	sessionMu   sync.Mutex
+	sessionHC   *http.Client
+	uploadBase  string
 }
 
-var defaultClient *storage.Client
-
 // NewCStore - creates an object suitable for accessing a predefined Bucket in GCP Cloud Storage
 func NewCStore(cred []byte, bucketName string) (*CStore, error) {
-	this := new(CStore)
 	if len(cred) == 0 || len(bucketName) == 0 {
 		return nil, errors.New(`invalid parameter(s)`)
 	}
-	var err error
-	this.client, err = storage.NewClient(context.Background(), option.WithCredentialsJSON(cred))
-	if err == nil && this.client != nil {
-		if defaultClient == nil {
-			defaultClient = this.client
-		}
-		this.bucket = this.client.Bucket(bucketName)
-	}
-	this.credentials = cred
-	return this, err
+	return NewCStoreWith(context.Background(), bucketName, WithCredentialsJSON(cred))
 }
 
 // NewCStoreP - creates an object suitable for accessing a predefined Bucket in GCP Cloud Storage, assumes permissions exist, no credentials required
-// note - it will reuse the default client for any subsequent calls.
+// note - each store has its own client, use NewCStoreWith and WithClient to share one
 func NewCStoreP(bucketName string) (*CStore, error) {
-	this := new(CStore)
-	if len(bucketName) == 0 {
-		return nil, errors.New(`invalid parameter(s)`)
-	}
-	if defaultClient == nil {
-		var err error
-		defaultClient, err = storage.NewClient(context.Background())
-		if err != nil {
-			return nil, err
-		}
+	return NewCStoreWith(context.Background(), bucketName)
+}
+
+// BucketName - the name of the bucket accessed by this store
+func (cs *CStore) BucketName() string {
+	return cs.bucket.Object(``).BucketName()
+}
+
+// SetTimeout - sets the default timeout applied to each individual cloud operation.
+// zero (the default) means operations are bounded only by the context passed in
+func (cs *CStore) SetTimeout(d time.Duration) {
+	cs.timeout = d
+}
+
+// Timeout - returns the default operation timeout
+func (cs *CStore) Timeout() time.Duration {
+	return cs.timeout
+}
+
+// opContext - derives the context for a single cloud operation, applying the default timeout if one is set
+func (cs *CStore) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cs.timeout > 0 {
+		return context.WithTimeout(ctx, cs.timeout)
 	}
-	this.client = defaultClient
-	this.bucket = this.client.Bucket(bucketName)
-	return this, nil
+	return context.WithCancel(ctx)
 }
 
 // GetFiles - return list of files within specified bucket / path
 func (cs *CStore) GetFiles(path string) ([]string, error) {
+	return cs.GetFilesCtx(context.Background(), path)
+}
+
+// GetFilesCtx - as GetFiles, bounded by ctx
+func (cs *CStore) GetFilesCtx(ctx context.Context, path string) ([]string, error) {
 	var result []string
-	var q = storage.Query{Prefix: path}
-	it := cs.bucket.Objects(context.Background(), &q)
-	for {
-		objAttrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
+	err := cs.retry(ctx, path, func(ctx context.Context) error {
+		result = nil
+		var q = storage.Query{Prefix: path}
+		it := cs.bucket.Objects(ctx, &q)
+		for {
+			objAttrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			result = append(result, objAttrs.Name)
 		}
-		result = append(result, objAttrs.Name)
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
@@ -83,15 +105,22 @@ func (cs *CStore) GetFiles(path string) ([]string, error) {
 // GetFilteredFiles - walk through the objects within specified path, passing each filename to a function
 // continues as long as pf result is true
 func (cs *CStore) GetFilteredFiles(path string, pf func(oa *storage.ObjectAttrs) bool) error {
+	return cs.GetFilteredFilesCtx(context.Background(), path, pf)
+}
+
+// GetFilteredFilesCtx - as GetFilteredFiles, bounded by ctx
+func (cs *CStore) GetFilteredFilesCtx(ctx context.Context, path string, pf func(oa *storage.ObjectAttrs) bool) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
 	var q = storage.Query{Prefix: path}
-	it := cs.bucket.Objects(context.Background(), &q)
+	it := cs.bucket.Objects(ctx, &q)
 	for {
 		objAttrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return err
+			return classify(path, err)
 		}
 		if !pf(objAttrs) {
 			break
@@ -103,15 +132,20 @@ func (cs *CStore) GetFilteredFiles(path string, pf func(oa *storage.ObjectAttrs)
 // DeleteOldFiles - delete all files within the specified path that are older than age in hours
 // returns # files deleted. Will stop if an error occurs
 func (cs *CStore) DeleteOldFiles(path string, ageh int) (int, error) {
+	return cs.DeleteOldFilesCtx(context.Background(), path, ageh)
+}
+
+// DeleteOldFilesCtx - as DeleteOldFiles, bounded by ctx. The default timeout applies to each underlying call
+func (cs *CStore) DeleteOldFilesCtx(ctx context.Context, path string, ageh int) (int, error) {
 	timeLimit := time.Now().Add(time.Duration(ageh*-1) * time.Hour)
 	result := 0
-	oa, err := cs.GetFileInfo(path)
+	oa, err := cs.GetFileInfoCtx(ctx, path)
 	if err != nil {
 		return 0, err
 	}
 	for _, attrs := range oa {
 		if attrs.Created.Before(timeLimit) {
-			e2 := cs.DeleteCloudFile(attrs.Name)
+			e2 := cs.DeleteCloudFileCtx(ctx, attrs.Name)
 			if e2 == nil {
 				result++
 			} else {
@@ -124,38 +158,60 @@ func (cs *CStore) DeleteOldFiles(path string, ageh int) (int, error) {
 
 // GetFileInfo - returns slice of files within the bucket
 func (cs *CStore) GetFileInfo(path string) ([]storage.ObjectAttrs, error) {
+	return cs.GetFileInfoCtx(context.Background(), path)
+}
+
+// GetFileInfoCtx - as GetFileInfo, bounded by ctx
+func (cs *CStore) GetFileInfoCtx(ctx context.Context, path string) ([]storage.ObjectAttrs, error) {
 	var result []storage.ObjectAttrs
-	var q = storage.Query{Prefix: path}
-	it := cs.bucket.Objects(context.Background(), &q)
-	for {
-		objAttrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
+	err := cs.retry(ctx, path, func(ctx context.Context) error {
+		result = nil
+		var q = storage.Query{Prefix: path}
+		it := cs.bucket.Objects(ctx, &q)
+		for {
+			objAttrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			result = append(result, *objAttrs)
 		}
-		result = append(result, *objAttrs)
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
 // GetFilesWithSuffix - returns list of files from the the specified path where the file name ends with suffix
 func (cs *CStore) GetFilesWithSuffix(path string, suffix string) ([]string, error) {
+	return cs.GetFilesWithSuffixCtx(context.Background(), path, suffix)
+}
+
+// GetFilesWithSuffixCtx - as GetFilesWithSuffix, bounded by ctx
+func (cs *CStore) GetFilesWithSuffixCtx(ctx context.Context, path string, suffix string) ([]string, error) {
 	var result []string
-	var q = storage.Query{Prefix: path}
-	it := cs.bucket.Objects(context.Background(), &q)
-	for {
-		objAttrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if strings.HasSuffix(objAttrs.Name, suffix) {
-			result = append(result, objAttrs.Name)
+	err := cs.retry(ctx, path, func(ctx context.Context) error {
+		result = nil
+		var q = storage.Query{Prefix: path}
+		it := cs.bucket.Objects(ctx, &q)
+		for {
+			objAttrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(objAttrs.Name, suffix) {
+				result = append(result, objAttrs.Name)
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
@@ -163,111 +219,161 @@ func (cs *CStore) GetFilesWithSuffix(path string, suffix string) ([]string, erro
 // GetFileReader - remember to close the Reader after use. returns error if file not found
 // second parameter is file size in bytes, if found
 func (cs *CStore) GetFileReader(fn string) (*storage.Reader, int64, error) {
-	it := cs.bucket.Object(fn)
+	return cs.GetFileReaderCtx(context.Background(), fn)
+}
+
+// GetFileReaderCtx - as GetFileReader, bounded by ctx.
+// The default timeout applies to locating the file only; reading the content is bounded by ctx alone,
+// as the reader outlives this call.
+func (cs *CStore) GetFileReaderCtx(ctx context.Context, fn string) (*storage.Reader, int64, error) {
+	it := cs.object(ctx, fn)
 	var fsize int64
-	ita, e1 := it.Attrs(context.Background())
+	e1 := cs.retry(ctx, fn, func(actx context.Context) error {
+		ita, err := it.Attrs(actx)
+		if err == nil {
+			fsize = ita.Size
+		}
+		return err
+	})
 	if e1 != nil {
 		return nil, fsize, e1
-	} else {
-		fsize = ita.Size
 	}
-	r, err := it.NewReader(context.Background())
+	r, err := cs.openReader(ctx, fn)
 	if err != nil {
 		return nil, fsize, err
 	}
 	return r, fsize, nil
 }
 
+// openReader - a reader of fn from a single request, its Attrs describe the generation read.
+// Attrs.Size is -1 when GCS decompresses gzip encoded content, as the length is not known in advance
+func (cs *CStore) openReader(ctx context.Context, fn string) (*storage.Reader, error) {
+	oh := cs.object(ctx, fn)
+	var r *storage.Reader
+	// the reader is opened with ctx rather than the attempt context, as it outlives this call
+	err := cs.retry(ctx, fn, func(context.Context) error {
+		var err error
+		r, err = oh.NewReader(ctx)
+		return err
+	})
+	return r, err
+}
+
 // DeleteCloudFile -
 func (cs *CStore) DeleteCloudFile(fn string) error {
+	return cs.DeleteCloudFileCtx(context.Background(), fn)
+}
+
+// DeleteCloudFileCtx - as DeleteCloudFile, bounded by ctx
+func (cs *CStore) DeleteCloudFileCtx(ctx context.Context, fn string) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
 	it := cs.bucket.Object(fn)
-	err := it.Delete(context.Background())
+	err := it.Delete(ctx)
 	if err != nil {
-		return err
+		return classify(fn, err)
 	}
 	return nil
 }
 
-// FileExists -
+// FileExists - false if the file does not exist, or if existence could not be determined (after retries),
+// use FileExistsCtx to distinguish the two
 func (cs *CStore) FileExists(fn string) bool {
-	it := cs.bucket.Object(fn)
-	_, err := it.Attrs(context.Background())
-	return err == nil
+	ok, _ := cs.FileExistsCtx(context.Background(), fn)
+	return ok
+}
+
+// FileExistsCtx - as FileExists, bounded by ctx. Any error other than ErrNotFound is returned
+func (cs *CStore) FileExistsCtx(ctx context.Context, fn string) (bool, error) {
+	return ObjectExists(ctx, cs, fn)
 }
 
 // WriteFile creates a text file in Google Cloud Storage.
 func (cs *CStore) WriteFile(fn string, content string) error {
-	return cs.WriteCloudFile(fn, []byte(content), "text/plain")
+	return cs.WriteFileCtx(context.Background(), fn, content)
+}
+
+// WriteFileCtx - as WriteFile, bounded by ctx
+func (cs *CStore) WriteFileCtx(ctx context.Context, fn string, content string) error {
+	return cs.WriteCloudFileCtx(ctx, fn, []byte(content), "text/plain")
 }
 
 // WriteCloudFile - write data to a file in the google cloud
 // fn is the dest filename/path
 // content - what to write
-// ftype is the Mime contentType
+// ftype is the Mime contentType, if empty it is inferred from fn or content (see DetectContentType)
 func (cs *CStore) WriteCloudFile(fn string, content []byte, ftype string) error {
-	wc := cs.bucket.Object(fn).NewWriter(context.Background())
-	wc.ContentType = ftype
-	if _, err := wc.Write(content); err != nil {
-		return err
-	}
-	if err := wc.Close(); err != nil {
-		return err
-	}
-	return nil
+	return cs.WriteCloudFileCtx(context.Background(), fn, content, ftype)
+}
+
+// WriteCloudFileCtx - as WriteCloudFile, bounded by ctx. Cancelling ctx abandons the upload
+func (cs *CStore) WriteCloudFileCtx(ctx context.Context, fn string, content []byte, ftype string) error {
+	return cs.WriteCloudFileOpts(ctx, fn, content, &WriteOptions{ContentType: ftype, InferContentType: true})
 }
 
 // CopyFile - from/to locations within the cloud
 func (cs *CStore) CopyFile(srcName string, destcs *CStore, dest string) error {
-	s := cs.bucket.Object(srcName)
-	d := destcs.bucket.Object(dest)
+	return cs.CopyFileCtx(context.Background(), srcName, destcs, dest)
+}
 
-	_, err := d.CopierFrom(s).Run(context.Background())
-	if err != nil {
+// CopyFileCtx - as CopyFile, bounded by ctx
+func (cs *CStore) CopyFileCtx(ctx context.Context, srcName string, destcs *CStore, dest string) error {
+	s := cs.object(ctx, srcName)
+	d := destcs.object(ctx, dest)
+
+	// a failed attempt resumes from the rewrite token held by the copier
+	c := d.CopierFrom(s)
+	return cs.retry(ctx, srcName, func(ctx context.Context) error {
+		_, err := c.Run(ctx)
 		return err
-	}
-	return nil
+	})
 }
 
 // CreateDownloadURL - create a signed, time limited url to access the specified file
 // https://cloud.google.com/storage/docs/access-control/signing-urls-manually
 // https://cloud.google.com/storage/docs/authentication/canonical-requests
 func (cs *CStore) CreateDownloadURL(minutes int, path string) (string, error) {
-	f := cs.bucket.Object(path)
-	conf, err := google.JWTConfigFromJSON(cs.credentials)
-	if err != nil {
-		return "", err
-	}
-	opts := &storage.SignedURLOptions{
-		Method:         "GET",
-		GoogleAccessID: conf.Email,
-		PrivateKey:     conf.PrivateKey,
-		Expires:        time.Now().Add(time.Duration(minutes) * time.Minute),
-	}
-	u, err := storage.SignedURL(f.BucketName(), path, opts)
-	if err != nil {
-		return "", err
-	}
-	return u, nil
+	return cs.CreateDownloadURLCtx(context.Background(), minutes, path)
+}
+
+// CreateDownloadURLCtx - as CreateDownloadURL, ctx bounds any remote signing (see SetSigner)
+func (cs *CStore) CreateDownloadURLCtx(ctx context.Context, minutes int, path string) (string, error) {
+	return cs.SignedURL(ctx, path, "GET", time.Duration(minutes)*time.Minute)
 }
 
 // DownloadFiles - assumes list of files contains folder names
 // dest is local file path
 func (cs *CStore) DownloadFiles(files []string, dest string) error {
+	return cs.DownloadFilesCtx(context.Background(), files, dest)
+}
+
+// DownloadFilesCtx - as DownloadFiles, bounded by ctx. The default timeout applies to each file in turn
+func (cs *CStore) DownloadFilesCtx(ctx context.Context, files []string, dest string) error {
 	for _, fn := range files {
-		cr, _, err := cs.GetFileReader(fn)
-		if err != nil {
+		if err := cs.downloadFile(ctx, fn, dest+filepath.Base(fn)); err != nil {
 			return err
 		}
-		if cr != nil {
-			c2, e1 := ioutil.ReadAll(cr)
-			if e1 != nil {
-				return e1
-			}
-			fb := filepath.Base(fn)
-			e2 := ioutil.WriteFile(dest+fb, c2, 0644)
-			if e2 != nil {
-				return e2
-			}
+	}
+	return nil
+}
+
+// downloadFile - copy a single cloud file to the local path lp, within the default timeout
+func (cs *CStore) downloadFile(ctx context.Context, fn string, lp string) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	cr, _, err := cs.GetFileReaderCtx(ctx, fn)
+	if err != nil {
+		return err
+	}
+	if cr != nil {
+		defer cr.Close()
+		c2, e1 := ioutil.ReadAll(cr)
+		if e1 != nil {
+			return e1
+		}
+		e2 := ioutil.WriteFile(lp, c2, 0644)
+		if e2 != nil {
+			return e2
 		}
 	}
 	return nil
@@ -2,16 +2,20 @@ package storage
 
 import (
 	"cloud.google.com/go/storage"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/cambefus/gcp_go_utils/secrets"
+	"github.com/cambefus/gcp_go_utils/storagetest"
 	"github.com/cambefus/gcp_go_utils/util"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // helper routines
@@ -21,7 +25,22 @@ var tfc = 0
 const fileContents = "this is sample content \n for the file"
 const testPath = `testing/`
 
+// setup - a store for the bucket named in utilities_config, or when that is not available,
+// for a bucket (with versioning enabled) on an in-process fake server
 func setup(t *testing.T) {
+	if cs == nil && !hasGCP() {
+		srv := storagetest.NewServer(`test-bucket`)
+		tmp, e := NewCStoreWith(context.Background(), `test-bucket`, WithEmulator(srv.URL))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = tmp.SetVersioning(context.Background(), true); e != nil {
+			t.Fatal(e)
+		}
+		signer, _ := offlineStore(t)
+		tmp.SetSigner(signer.signer)
+		cs = tmp
+	}
 	if cs == nil {
 		s, e := secrets.InitializeFromEnvironment(`utilities_config`)
 		if e != nil {
@@ -39,6 +58,18 @@ func setup(t *testing.T) {
 	}
 }
 
+// hasGCP - true if tests can use a GCP bucket
+func hasGCP() bool {
+	return len(os.Getenv(`utilities_config`)) > 0
+}
+
+// requireGCP - skips tests needing features the fake server does not provide
+func requireGCP(t *testing.T) {
+	if !hasGCP() {
+		t.Skip(`requires utilities_config for access to GCP`)
+	}
+}
+
 // cloud storage will invoke rate limit errors if you perform to many calls against an
 // individual file too quickly, so we need to change the file name for each test
 func writeTestFiles(t *testing.T) []string {
@@ -68,6 +99,7 @@ func deleteTestFiles(t *testing.T, fnames []string) {
 
 func Test_NewCStoreP(t *testing.T) {
 	// this function should never work in a test environment, as it will not have permissions
+	requireGCP(t)
 	csp, err := NewCStoreP("Sample")
 	if err != nil {
 		t.Error("NewCStoreP: ", err)
@@ -81,96 +113,125 @@ func Test_NewCStoreP(t *testing.T) {
 	}
 
 	csp2, _ := NewCStoreP("Sample2")
-	if !(csp2.client == csp.client) {
-		t.Error("Storage client should have been reused")
+	if csp2.client == csp.client {
+		t.Error("Storage client should not have been shared")
+	}
+	csp3, _ := NewCStoreWith(context.Background(), "Sample3", WithClient(csp.Client()))
+	if csp3.client != csp.client {
+		t.Error("Storage client should have been shared")
+	}
+	if csp3.Close() != nil || csp2.Close() != nil || csp.Close() != nil {
+		t.Error("failed to close stores")
 	}
 }
 
 func Test_FileExists(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	if !cs.FileExists(f[0]) {
-		t.Error(`cloud storage verification function failed`)
-	}
-	deleteTestFiles(t, f)
-	if cs.FileExists(f[0]) {
-		t.Error(`should not have found file`)
-	}
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		ctx := context.Background()
+		f := writeStoreFiles(t, st)
+		if ok, e := ObjectExists(ctx, st, f[0]); !ok || e != nil {
+			t.Error(`cloud storage verification function failed`, e)
+		}
+		deleteStoreFiles(t, st, f)
+		if ok, _ := ObjectExists(ctx, st, f[0]); ok {
+			t.Error(`should not have found file`)
+		}
+		if c, ok := st.(*CStore); ok && c.FileExists(f[0]) {
+			t.Error(`should not have found file`)
+		}
+	})
 }
 
 func Test_getFiles(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	fl, e := cs.GetFiles(testPath)
-	if e != nil {
-		t.Error(e)
-	}
-	if len(fl) != 2 {
-		t.Error("GCP Storage: failed to find expected files")
-	}
-	deleteTestFiles(t, f)
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		l, e := st.List(context.Background(), testPath)
+		if e != nil {
+			t.Error(e)
+		}
+		if len(l) != 2 {
+			t.Error("GCP Storage: failed to find expected files")
+		}
+		if c, ok := st.(*CStore); ok {
+			if fl, _ := c.GetFiles(testPath); len(fl) != 2 {
+				t.Error("GCP Storage: failed to find expected files")
+			}
+		}
+	})
 }
 
 func Test_GetFilesBFilter(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	fcnt := 0
-	var pf = func(oa *storage.ObjectAttrs) bool {
-		if strings.HasSuffix(oa.Name, `txt`) {
-			fcnt++
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		fcnt := 0
+		var pf = func(oa *storage.ObjectAttrs) bool {
+			if strings.HasSuffix(oa.Name, `txt`) {
+				fcnt++
+			}
+			return true
 		}
-		return true
-	}
-	e := cs.GetFilteredFiles(testPath, pf)
-	if e != nil {
-		t.Error(e)
-	}
-	if fcnt != 1 {
-		t.Error("GetFilesBFilter: failed to return expected count")
-	}
-	deleteTestFiles(t, f)
+		if c, ok := st.(*CStore); ok {
+			if e := c.GetFilteredFiles(testPath, pf); e != nil {
+				t.Error(e)
+			}
+		} else {
+			l, e := st.List(context.Background(), testPath)
+			if e != nil {
+				t.Error(e)
+			}
+			for i := range l {
+				if !pf(&l[i]) {
+					break
+				}
+			}
+		}
+		if fcnt != 1 {
+			t.Error("GetFilesBFilter: failed to return expected count")
+		}
+	})
 }
 
 func Test_copy(t *testing.T) {
-	setup(t)
-	fn := testPath + `cpy.txt`
-	if !(cs.WriteFile(fn, fileContents) == nil) {
-		t.Error(fn)
-	}
-	fn2 := testPath + `cpy2.txt`
-	if !(cs.CopyFile(fn, cs, fn2) == nil) {
-		t.Error("copy failed")
-	}
-
-	e := cs.DeleteCloudFile(fn)
-	if e != nil {
-		t.Error(e)
-	}
-	e2 := cs.DeleteCloudFile(fn2)
-	if e2 != nil {
-		t.Error(e2)
-	}
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		ctx := context.Background()
+		fn := testPath + `cpy.txt`
+		if !(st.Write(ctx, fn, []byte(fileContents), `text/plain`) == nil) {
+			t.Error(fn)
+		}
+		fn2 := testPath + `cpy2.txt`
+		if !(st.Copy(ctx, fn, st, fn2) == nil) {
+			t.Error("copy failed")
+		}
+		if b, _ := ReadObject(ctx, st, fn2); string(b) != fileContents {
+			t.Error("copied content does not match")
+		}
+		deleteStoreFiles(t, st, []string{fn, fn2})
+	})
 }
 
 func Test_getFileReader(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	cr, _, e := cs.GetFileReader(f[0])
-	if e != nil {
-		t.Error(e)
-	}
-	defer cr.Close()
-	c2, e2 := ioutil.ReadAll(cr)
-	if e2 != nil {
-		t.Error(e2)
-	}
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		cr, _, e := st.NewReader(context.Background(), f[0])
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer cr.Close()
+		c2, e2 := ioutil.ReadAll(cr)
+		if e2 != nil {
+			t.Error(e2)
+		}
 
-	if fileContents != string(c2) {
-		t.Errorf(`Expected "%s" got "%s"`, fileContents, c2)
-	}
-	deleteTestFiles(t, f)
+		if fileContents != string(c2) {
+			t.Errorf(`Expected "%s" got "%s"`, fileContents, c2)
+		}
+	})
 }
 
+// Test_DeleteOldFiles - DeleteOldFiles, like SetTimeout below, is specific to CStore
 func Test_DeleteOldFiles(t *testing.T) {
 	setup(t)
 	writeTestFiles(t)
@@ -198,81 +259,113 @@ func Test_DeleteOldFiles(t *testing.T) {
 }
 
 func Test_DownloadFiles(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	const localDir = `./`
-	flist, e := cs.GetFiles(testPath)
-	if e != nil {
-		t.Error(e)
-	}
-	err := cs.DownloadFiles(flist, localDir)
-	if err != nil {
-		t.Error(`DownloadFiles: `, err)
-	}
-	for _, i2 := range flist {
-		fb := filepath.Base(i2)
-		if !util.FileExists(localDir + fb) {
-			t.Error(`DownloadFiles - failed to find local file`)
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		localDir := t.TempDir() + `/`
+		if c, ok := st.(*CStore); ok {
+			if err := c.DownloadFiles(f, localDir); err != nil {
+				t.Error(`DownloadFiles: `, err)
+			}
+		} else if err := Download(context.Background(), st, f, localDir, TransferOptions{StripPrefix: path.Dir(f[0]) + `/`}).Err(); err != nil {
+			t.Error(`Download: `, err)
 		}
-		_ = os.Remove(localDir + fb)
-	}
-	deleteTestFiles(t, f)
+		for _, i2 := range f {
+			if !util.FileExists(localDir + filepath.Base(i2)) {
+				t.Error(`DownloadFiles - failed to find local file`)
+			}
+		}
+	})
 }
 
 func Test_getFilesWithSuffix(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	defer deleteTestFiles(t, f)
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
 
-	f1, e := cs.GetFiles(testPath)
-	if e != nil {
-		t.Error(e)
-	}
-	f2, e2 := cs.GetFilesWithSuffix(testPath, `.txt`)
-	if e2 != nil {
-		t.Error(e2)
-	}
-	if (len(f1) != 2) || (len(f2) != 1) {
-		t.Errorf("Expected 2 & 1, got %d & %d", len(f1), len(f2))
-	}
+		l, e := st.List(context.Background(), testPath)
+		if e != nil {
+			t.Error(e)
+		}
+		var f2 []string
+		for _, oa := range l {
+			if strings.HasSuffix(oa.Name, `.txt`) {
+				f2 = append(f2, oa.Name)
+			}
+		}
+		if c, ok := st.(*CStore); ok {
+			var e2 error
+			if f2, e2 = c.GetFilesWithSuffix(testPath, `.txt`); e2 != nil {
+				t.Error(e2)
+			}
+		}
+		if (len(l) != 2) || (len(f2) != 1) {
+			t.Errorf("Expected 2 & 1, got %d & %d", len(l), len(f2))
+		}
+	})
 }
 
 func Test_CreateDownloadURL(t *testing.T) {
-	setup(t)
-	f := writeTestFiles(t)
-	r, e := cs.GetFiles(testPath)
-	if e != nil {
-		t.Error(e)
-	}
-	defer deleteTestFiles(t, f)
-	if len(r) == 0 {
-		t.Error(`No files found in bucket`)
-	} else {
-		u, e1 := cs.CreateDownloadURL(5, r[1])
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		var u string
+		var e1 error
+		if c, ok := st.(*CStore); ok {
+			u, e1 = c.CreateDownloadURL(5, f[1])
+		} else {
+			u, e1 = st.SignedURL(context.Background(), f[1], `GET`, 5*time.Minute)
+		}
 		if e1 != nil {
 			t.Errorf("Got error %v", e1)
 		} else {
 			fmt.Println(u)
 		}
-	}
+	})
 }
 
 func Test_GetFileInfo(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st ObjectStore) {
+		f := writeStoreFiles(t, st)
+		defer deleteStoreFiles(t, st, f)
+		r, e := st.List(context.Background(), testPath)
+		if c, ok := st.(*CStore); ok {
+			r, e = c.GetFileInfo(testPath)
+		}
+		if e != nil {
+			t.Error(e)
+		}
+		if len(r) != 2 {
+			t.Fatalf(`Expected 2 files found for GetFileInfo, got %d `, len(r))
+		}
+		ok := r[1].ContentType == `application/json`
+		if _, local := st.(*LocalStore); local {
+			// the local store derives the type from the extension, the system mime tables may add parameters
+			ok = strings.HasPrefix(r[1].ContentType, `application/json`)
+		}
+		if !ok {
+			t.Errorf(`Unexpected content type - %s`, r[1].ContentType)
+		}
+		if r[1].Size != 37 {
+			t.Errorf(`Unexpected filesize - %d`, r[1].Size)
+		}
+	})
+}
+
+func Test_Context(t *testing.T) {
 	setup(t)
-	f := writeTestFiles(t)
-	defer deleteTestFiles(t, f)
-	r, e := cs.GetFileInfo(testPath)
-	if e != nil {
-		t.Error(e)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, e := cs.GetFilesCtx(ctx, testPath); e == nil {
+		t.Error(`GetFilesCtx: expected error from cancelled context`)
 	}
-	if len(r) != 2 {
-		t.Errorf(`Expected 2 files found for GetFileInfo, got %d `, len(r))
-	}
-	if r[1].ContentType != `application/json` {
-		t.Errorf(`Unexpected content type - %s`, r[1].ContentType)
-	}
-	if r[1].Size != 37 {
-		t.Errorf(`Unexpected filesize - %d`, r[1].Size)
+	if e := cs.WriteFileCtx(ctx, testPath+`ctx.txt`, fileContents); e == nil {
+		t.Error(`WriteFileCtx: expected error from cancelled context`)
 	}
 
+	cs.SetTimeout(time.Nanosecond)
+	defer cs.SetTimeout(0)
+	if _, e := cs.GetFileInfo(testPath); e == nil {
+		t.Error(`GetFileInfo: expected timeout error`)
+	}
 }
@@ -0,0 +1,140 @@
+package storage
+
+/*
+	server side composition of objects, and parallel multi-part upload built upon it
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MaxComposeSources - the most objects GCS will compose in a single request
+const MaxComposeSources = 32
+
+// defaultPartSize - part size used by UploadParallel when none is given
+const defaultPartSize = 32 << 20
+
+// Compose - concatenates the sources (in order) into dest, entirely within the cloud. More than MaxComposeSources
+// sources are composed recursively via temporary objects, which are removed afterwards.
+// opts (which may be nil) sets the attributes of dest and any preconditions upon it, Gzip does not apply.
+// Note that composite objects have a CRC32C but no MD5 hash
+func (cs *CStore) Compose(ctx context.Context, dest string, sources []string, opts *WriteOptions) (*storage.ObjectAttrs, error) {
+	if len(dest) == 0 || len(sources) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	var temps []string
+	defer func() {
+		// best effort, the temporaries are of no further use whatever the outcome
+		for _, t := range temps {
+			_ = cs.DeleteCloudFileCtx(context.Background(), t)
+		}
+	}()
+	tmpPrefix := dest + `.compose-` + strconv.FormatInt(time.Now().UnixNano(), 36) + `-`
+	level := 0
+	for len(sources) > MaxComposeSources {
+		var next []string
+		for i := 0; i < len(sources); i += MaxComposeSources {
+			end := i + MaxComposeSources
+			if end > len(sources) {
+				end = len(sources)
+			}
+			tn := fmt.Sprintf(`%s%d-%d`, tmpPrefix, level, len(next))
+			temps = append(temps, tn)
+			if _, err := cs.composeOnce(ctx, tn, sources[i:end], nil); err != nil {
+				return nil, err
+			}
+			next = append(next, tn)
+		}
+		sources = next
+		level++
+	}
+	return cs.composeOnce(ctx, dest, sources, opts)
+}
+
+// composeOnce - a single compose request of at most MaxComposeSources objects
+func (cs *CStore) composeOnce(ctx context.Context, dest string, sources []string, opts *WriteOptions) (*storage.ObjectAttrs, error) {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	srcs := make([]*storage.ObjectHandle, len(sources))
+	for i, s := range sources {
+		// sources must not carry a key, the destination key is used for them
+		srcs[i] = cs.bucket.Object(s)
+	}
+	d := cs.object(ctx, dest)
+	if opts != nil {
+		d = withConditions(d, opts.Conditions)
+	}
+	c := d.ComposerFrom(srcs...)
+	opts.apply(&c.ObjectAttrs)
+	if opts != nil && opts.Gzip {
+		// compose does not compress, so only an explicit ContentEncoding applies
+		c.ContentEncoding = opts.ContentEncoding
+	}
+	a, err := c.Run(ctx)
+	return a, classify(dest, err)
+}
+
+// UploadParallel - uploads a large local file as parts of partSize bytes (defaults to 32MiB) in parallel,
+// then composes them into dest. The parts are removed afterwards, whether or not the upload succeeds.
+// topts controls the concurrency and retries of the part uploads, opts (which may be nil) applies to dest.
+// Gzip is not supported, as composed parts cannot form a single gzip stream
+func (cs *CStore) UploadParallel(ctx context.Context, localFile string, dest string, partSize int64,
+	topts TransferOptions, opts *WriteOptions) (*storage.ObjectAttrs, error) {
+	if opts != nil && opts.Gzip {
+		return nil, errors.New(`gzip is not supported by parallel uploads`)
+	}
+	f, err := os.Open(localFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	count := (fi.Size() + partSize - 1) / partSize
+	if count <= 1 {
+		_, err = cs.WriteFrom(ctx, dest, f, opts)
+		if err != nil {
+			return nil, err
+		}
+		return cs.Attrs(ctx, dest)
+	}
+
+	prefix := dest + `.part-` + strconv.FormatInt(time.Now().UnixNano(), 36) + `-`
+	results := make([]TransferResult, count)
+	sections := make(map[*TransferResult]*io.SectionReader, count)
+	parts := make([]string, count)
+	for i := range results {
+		parts[i] = fmt.Sprintf(`%s%05d`, prefix, i)
+		results[i] = TransferResult{Object: parts[i], Local: localFile}
+		sections[&results[i]] = io.NewSectionReader(f, int64(i)*partSize, partSize)
+	}
+	defer func() {
+		for _, p := range parts {
+			_ = cs.DeleteCloudFileCtx(context.Background(), p)
+		}
+	}()
+	rep := runTransfers(ctx, results, topts, func(ctx context.Context, r *TransferResult) error {
+		sr := sections[r]
+		if _, err := sr.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var err error
+		_, r.Bytes, err = writeObject(ctx, cs.object(ctx, r.Object), sr, nil)
+		return err
+	})
+	if err = rep.Err(); err != nil {
+		return nil, err
+	}
+	return cs.Compose(ctx, dest, parts, opts)
+}
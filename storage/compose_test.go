@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Compose(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	var parts []string
+	var want strings.Builder
+	for i := 0; i <= MaxComposeSources; i++ {
+		fn := fmt.Sprintf(`%scompose/%02d.txt`, testPath, i)
+		c := fmt.Sprintf("line %d\n", i)
+		if e := cs.WriteFile(fn, c); e != nil {
+			t.Fatal(e)
+		}
+		parts = append(parts, fn)
+		want.WriteString(c)
+	}
+	defer deleteTestFiles(t, parts)
+
+	dest := testPath + `composed.txt`
+	a, e := cs.Compose(ctx, dest, parts, &WriteOptions{ContentType: `text/plain`})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer deleteTestFiles(t, []string{dest})
+	if a.Size != int64(want.Len()) || a.ContentType != `text/plain` {
+		t.Errorf(`unexpected attributes %+v`, a)
+	}
+	b, _ := ReadObject(ctx, cs, dest)
+	if string(b) != want.String() {
+		t.Error(`composed content does not match`)
+	}
+	if l, _ := cs.GetFiles(dest + `.compose`); len(l) != 0 {
+		t.Error(`temporary objects were not removed`, l)
+	}
+}
+
+func Test_UploadParallel(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	content := strings.Repeat(fileContents, 100)
+	lf := filepath.Join(t.TempDir(), `big.txt`)
+	if e := ioutil.WriteFile(lf, []byte(content), 0644); e != nil {
+		t.Fatal(e)
+	}
+	dest := testPath + `parallel.txt`
+	a, e := cs.UploadParallel(ctx, lf, dest, 1000, TransferOptions{Workers: 3}, &WriteOptions{ContentType: `text/plain`})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer deleteTestFiles(t, []string{dest})
+	if a.Size != int64(len(content)) {
+		t.Errorf(`expected %d bytes, got %d`, len(content), a.Size)
+	}
+	if b, _ := ReadObject(ctx, cs, dest); string(b) != content {
+		t.Error(`uploaded content does not match`)
+	}
+	if l, _ := cs.GetFiles(dest + `.part`); len(l) != 0 {
+		t.Error(`part objects were not removed`, l)
+	}
+	// gzip is rejected whatever the size of the file
+	for _, ps := range []int64{1000, int64(len(content))} {
+		if _, e = cs.UploadParallel(ctx, lf, dest, ps, TransferOptions{}, &WriteOptions{Gzip: true}); e == nil {
+			t.Error(`expected gzip to be rejected, part size`, ps)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package storage
+
+/*
+	generation preconditions, the basis for optimistic concurrency on top of GCS:
+	read an object noting its generation, then write / delete only if that generation is still current
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+)
+
+// withConditions - applies conds to the handle, nil or empty conditions leave it unchanged
+func withConditions(oh *storage.ObjectHandle, conds *storage.Conditions) *storage.ObjectHandle {
+	if conds == nil || *conds == (storage.Conditions{}) {
+		return oh
+	}
+	return oh.If(*conds)
+}
+
+// DeleteIf - delete a file only if conds are met, e.g. storage.Conditions{GenerationMatch: gen}
+func (cs *CStore) DeleteIf(ctx context.Context, fn string, conds storage.Conditions) error {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	return classify(fn, withConditions(cs.bucket.Object(fn), &conds).Delete(ctx))
+}
+
+// CopyFileIf - as CopyFile, srcConds apply to the source object and destConds to the destination, either may be empty.
+// returns the attributes of the new object
+func (cs *CStore) CopyFileIf(ctx context.Context, srcName string, srcConds storage.Conditions,
+	destcs *CStore, dest string, destConds storage.Conditions) (*storage.ObjectAttrs, error) {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	s := withConditions(cs.object(ctx, srcName), &srcConds)
+	d := withConditions(destcs.object(ctx, dest), &destConds)
+	a, err := d.CopierFrom(s).Run(ctx)
+	return a, classify(dest, err)
+}
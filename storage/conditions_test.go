@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_Conditions(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	fn := testPath + `cond.txt`
+	create := &WriteOptions{ContentType: `text/plain`, Conditions: &storage.Conditions{DoesNotExist: true}}
+	a, e := cs.WriteObject(ctx, fn, []byte(fileContents), create)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer deleteTestFiles(t, []string{fn})
+
+	// a second create must fail
+	if _, e = cs.WriteObject(ctx, fn, []byte(`other`), create); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition, got`, e)
+	}
+
+	// replace only while the generation is unchanged
+	match := &WriteOptions{ContentType: `text/plain`, Conditions: &storage.Conditions{GenerationMatch: a.Generation}}
+	a2, e := cs.WriteObject(ctx, fn, []byte(`v2`), match)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = cs.WriteObject(ctx, fn, []byte(`v3`), match); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition for stale generation, got`, e)
+	}
+
+	// copy to an existing object must fail when DoesNotExist is required
+	fn2 := testPath + `cond2.txt`
+	if _, e = cs.CopyFileIf(ctx, fn, storage.Conditions{GenerationMatch: a2.Generation}, cs, fn2, storage.Conditions{DoesNotExist: true}); e != nil {
+		t.Error(e)
+	}
+	if _, e = cs.CopyFileIf(ctx, fn, storage.Conditions{}, cs, fn2, storage.Conditions{DoesNotExist: true}); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition on copy, got`, e)
+	}
+
+	if e = cs.DeleteIf(ctx, fn, storage.Conditions{GenerationMatch: a.Generation}); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition on delete, got`, e)
+	}
+	if e = cs.DeleteIf(ctx, fn2, storage.Conditions{}); e != nil {
+		t.Error(e)
+	}
+}
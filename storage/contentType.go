@@ -0,0 +1,93 @@
+package storage
+
+/*
+	content type inference for uploads
+	types are taken from a registry of overrides by file extension, then the system mime types, and
+	finally by sniffing the content
+*/
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// sniffLen - the most content examined when sniffing
+const sniffLen = 512
+
+const defaultContentType = `application/octet-stream`
+
+// ContentTypes - a registry of content types by file extension, taking precedence over the system mime types
+type ContentTypes struct {
+	mu    sync.RWMutex
+	byExt map[string]string
+}
+
+// DefaultContentTypes - the registry used when inferring content types for uploads
+var DefaultContentTypes = NewContentTypes()
+
+// NewContentTypes - an empty registry
+func NewContentTypes() *ContentTypes {
+	return &ContentTypes{byExt: map[string]string{}}
+}
+
+// normalizeExt - lower case, with a leading "."
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, `.`) {
+		ext = `.` + ext
+	}
+	return ext
+}
+
+// Register - sets the content type for files with the extension ext (e.g. ".csv"), an empty type removes the override
+func (ct *ContentTypes) Register(ext string, contentType string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if len(contentType) == 0 {
+		delete(ct.byExt, normalizeExt(ext))
+	} else {
+		ct.byExt[normalizeExt(ext)] = contentType
+	}
+}
+
+// ByName - the content type for name from its extension, or "" if unknown
+func (ct *ContentTypes) ByName(name string) string {
+	ext := path.Ext(name)
+	if len(ext) == 0 {
+		return ``
+	}
+	ct.mu.RLock()
+	t, ok := ct.byExt[normalizeExt(ext)]
+	ct.mu.RUnlock()
+	if ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Detect - the content type for name, sniffing content (of which only the first 512 bytes are needed)
+// if the extension is unknown
+func (ct *ContentTypes) Detect(name string, content []byte) string {
+	if t := ct.ByName(name); len(t) > 0 {
+		return t
+	}
+	if len(content) == 0 {
+		return defaultContentType
+	}
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+	}
+	return http.DetectContentType(content)
+}
+
+// RegisterContentType - sets an override in DefaultContentTypes
+func RegisterContentType(ext string, contentType string) {
+	DefaultContentTypes.Register(ext, contentType)
+}
+
+// DetectContentType - see ContentTypes.Detect, using DefaultContentTypes
+func DetectContentType(name string, content []byte) string {
+	return DefaultContentTypes.Detect(name, content)
+}
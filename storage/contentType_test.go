@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	ct := NewContentTypes()
+	ct.Register(`CSV`, `text/csv; charset=utf-8`)
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A....")
+	for _, c := range []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{`data/report.csv`, nil, `text/csv; charset=utf-8`},
+		{`data/REPORT.Csv`, nil, `text/csv; charset=utf-8`},
+		{`data/page.html`, nil, `text/html; charset=utf-8`},
+		{`data/image`, png, `image/png`},
+		{`data/notes`, []byte(fileContents), `text/plain; charset=utf-8`},
+		{`data/empty`, nil, `application/octet-stream`},
+	} {
+		if got := ct.Detect(c.name, c.content); got != c.want {
+			t.Errorf(`%s: expected %s, got %s`, c.name, c.want, got)
+		}
+	}
+	ct.Register(`.state`, `application/json`)
+	if got := ct.ByName(`a.state`); got != `application/json` {
+		t.Errorf(`expected override, got %s`, got)
+	}
+	ct.Register(`.state`, ``)
+	if got := ct.ByName(`a.state`); got != `` {
+		t.Errorf(`expected override to be removed, got %s`, got)
+	}
+}
+
+func Test_InferContentType(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	RegisterContentType(`.state`, `application/json`)
+	defer RegisterContentType(`.state`, ``)
+
+	f1, f2 := testPath+`infer/a.state`, testPath+`infer/image`
+	if err := cs.WriteCloudFile(f1, []byte(`{}`), ``); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.DeleteCloudFile(f1)
+	if _, err := cs.WriteFrom(ctx, f2, strings.NewReader("\x89PNG\x0D\x0A\x1A\x0A...."), &WriteOptions{InferContentType: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.DeleteCloudFile(f2)
+	for fn, want := range map[string]string{f1: `application/json`, f2: `image/png`} {
+		if a, err := cs.Attrs(ctx, fn); err != nil || a.ContentType != want {
+			t.Errorf(`%s: expected %s, got %v %v`, fn, want, a, err)
+		}
+	}
+}
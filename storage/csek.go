@@ -0,0 +1,91 @@
+package storage
+
+/*
+	customer supplied encryption keys (CSEK)
+	objects written with a customer supplied AES-256 key can only be read, copied or have their attributes
+	(hashes) retrieved by supplying the same key. A key may be set for all operations of a CStore, or for an
+	individual call by attaching it to the context
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/secrets"
+)
+
+// EncryptionKeySize - customer supplied keys are AES-256 keys
+const EncryptionKeySize = 32
+
+var errKeySize = errors.New(`encryption key must be 32 bytes`)
+
+type encryptionKeyCtx struct{}
+
+// WithEncryptionKey - returns a context that applies key to the object operations of any CStore it is passed to,
+// in place of the store's own key. Copies use the key for both the source and destination
+func WithEncryptionKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, encryptionKeyCtx{}, key)
+}
+
+// SetEncryptionKey - sets the key used for all object operations of this store, nil removes it
+func (cs *CStore) SetEncryptionKey(key []byte) error {
+	if key != nil && len(key) != EncryptionKeySize {
+		return errKeySize
+	}
+	cs.key = key
+	return nil
+}
+
+// EncryptionKeyFromSecrets - a key held base64 encoded in the named secrets entry
+func EncryptionKeyFromSecrets(s *secrets.Secrets, name string) ([]byte, error) {
+	if s == nil || !s.KeyExists(name) {
+		return nil, errors.New(`secret not found: ` + name)
+	}
+	k, err := base64.StdEncoding.DecodeString(s.GetString(name))
+	if err != nil {
+		return nil, errors.New(`secret is not base64 encoded: ` + name)
+	}
+	if len(k) != EncryptionKeySize {
+		return nil, errKeySize
+	}
+	return k, nil
+}
+
+// encryptionKey - the key from ctx or else the store's key, nil if neither is set
+func (cs *CStore) encryptionKey(ctx context.Context) []byte {
+	if k, ok := ctx.Value(encryptionKeyCtx{}).([]byte); ok && k != nil {
+		return k
+	}
+	return cs.key
+}
+
+// object - a handle for name, using the key from ctx or else the store's key
+func (cs *CStore) object(ctx context.Context, name string) *storage.ObjectHandle {
+	oh := cs.bucket.Object(name)
+	if k := cs.encryptionKey(ctx); k != nil {
+		return oh.Key(k)
+	}
+	return oh
+}
+
+// RotateEncryptionKey - rewrites name in place, from oldKey to newKey, using the rewrite api so the content does not
+// leave the cloud. A nil oldKey means the object is not currently encrypted with a customer supplied key, a nil newKey
+// returns it to Google managed encryption. The rewrite only replaces the generation found at the start, so a
+// concurrent update results in a PreconditionError rather than being lost
+func (cs *CStore) RotateEncryptionKey(ctx context.Context, name string, oldKey, newKey []byte) (*storage.ObjectAttrs, error) {
+	for _, k := range [][]byte{oldKey, newKey} {
+		if k != nil && len(k) != EncryptionKeySize {
+			return nil, errKeySize
+		}
+	}
+	src := cs.bucket.Object(name).Key(oldKey)
+	actx, cancel := cs.opContext(ctx)
+	a, err := src.Attrs(actx)
+	cancel()
+	if err != nil {
+		return nil, classify(name, err)
+	}
+	pin := storage.Conditions{GenerationMatch: a.Generation}
+	c := cs.copier(src.Generation(a.Generation), cs.bucket.Object(name).Key(newKey).If(pin), nil)
+	return cs.runCopier(ctx, c, name)
+}
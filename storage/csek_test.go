@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/cambefus/gcp_go_utils/secrets"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptionKeys(t *testing.T) {
+	st := &CStore{}
+	if st.SetEncryptionKey([]byte(`short`)) == nil {
+		t.Error(`expected short key to be rejected`)
+	}
+	if e := st.SetEncryptionKey(make([]byte, EncryptionKeySize)); e != nil {
+		t.Error(e)
+	}
+	if e := st.SetEncryptionKey(nil); e != nil || st.key != nil {
+		t.Error(`expected key to be removed`, e)
+	}
+
+	k := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, EncryptionKeySize))
+	s, _ := secrets.Parse([]byte(`{"ConfigName": "t", "Records": [{"Key": "csek", "Value": "` + k + `"}]}`))
+	if b, e := EncryptionKeyFromSecrets(s, `csek`); e != nil || len(b) != EncryptionKeySize {
+		t.Error(`expected key from secrets`, e)
+	}
+	if _, e := EncryptionKeyFromSecrets(s, `missing`); e == nil {
+		t.Error(`expected missing key to fail`)
+	}
+}
+
+func Test_CustomerSuppliedKeys(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	k1, k2 := bytes.Repeat([]byte{1}, EncryptionKeySize), bytes.Repeat([]byte{2}, EncryptionKeySize)
+	fn := testPath + `csek.txt`
+	if _, e := cs.WriteObject(WithEncryptionKey(ctx, k1), fn, []byte(fileContents), nil); e != nil {
+		t.Fatal(e)
+	}
+	defer cs.DeleteCloudFile(fn)
+
+	read := func(ctx context.Context) (string, error) {
+		r, _, e := cs.GetFileReaderCtx(ctx, fn)
+		if e != nil {
+			return ``, e
+		}
+		defer r.Close()
+		b, e := ioutil.ReadAll(r)
+		return string(b), e
+	}
+	if _, e := read(ctx); e == nil {
+		t.Error(`expected read without key to fail`)
+	}
+	if s, e := read(WithEncryptionKey(ctx, k1)); e != nil || s != fileContents {
+		t.Error(`expected read with key`, e)
+	}
+
+	if _, e := cs.RotateEncryptionKey(ctx, fn, k1, k2); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := read(WithEncryptionKey(ctx, k1)); e == nil {
+		t.Error(`expected old key to fail after rotation`)
+	}
+	if s, e := read(WithEncryptionKey(ctx, k2)); e != nil || s != fileContents {
+		t.Error(`expected read with new key`, e)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+/*
+	JSON documents held in objects, with optimistic locking
+	each document is a single object, read and written as JSON (without HTML escaping). Updates are read-modify-write
+	cycles guarded by the generation of the object read, so concurrent updates are never lost
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/util"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// defaultUpdateAttempts - attempts at an Update before giving up on conflicting writers
+const defaultUpdateAttempts = 10
+
+// Documents - JSON documents stored as objects below a prefix
+type Documents struct {
+	cs     *CStore
+	prefix string
+	// MaxAttempts - attempts at an Update when other writers change the document, defaults to 10
+	MaxAttempts int
+	// CacheControl - applied to documents written, e.g. "no-store" so readers never see stale content
+	CacheControl string
+}
+
+// Documents - access to JSON documents named prefix + name
+func (cs *CStore) Documents(prefix string) *Documents {
+	return &Documents{cs: cs, prefix: prefix, MaxAttempts: defaultUpdateAttempts}
+}
+
+// Get - reads the document into v, returning the generation read. A missing document is reported as ErrNotFound
+func (d *Documents) Get(ctx context.Context, name string, v interface{}) (int64, error) {
+	r, _, err := d.cs.GetFileReaderCtx(ctx, d.prefix+name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if err = json.NewDecoder(r).Decode(v); err != nil {
+		return 0, errors.New(`invalid document ` + d.prefix + name + `: ` + err.Error())
+	}
+	return r.Attrs.Generation, nil
+}
+
+// Put - writes v as the document, replacing any existing content, returning the new generation
+func (d *Documents) Put(ctx context.Context, name string, v interface{}) (int64, error) {
+	return d.put(ctx, name, v, nil, false)
+}
+
+// PutIf - as Put, only if the document is at generation (0 meaning it must not exist),
+// otherwise an error matching ErrPrecondition is returned
+func (d *Documents) PutIf(ctx context.Context, name string, v interface{}, generation int64) (int64, error) {
+	return d.putIf(ctx, name, v, generation, false)
+}
+
+func (d *Documents) putIf(ctx context.Context, name string, v interface{}, generation int64, once bool) (int64, error) {
+	conds := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conds = storage.Conditions{DoesNotExist: true}
+	}
+	return d.put(ctx, name, v, &conds, once)
+}
+
+// put - writes v as the document, once making a single attempt at the write
+func (d *Documents) put(ctx context.Context, name string, v interface{}, conds *storage.Conditions, once bool) (int64, error) {
+	b, err := util.JSONMarshalNoEscape(v)
+	if err != nil {
+		return 0, err
+	}
+	a, err := d.cs.WriteObject(ctx, d.prefix+name, b, &WriteOptions{ContentType: `application/json`,
+		CacheControl: d.CacheControl, Conditions: conds, once: once})
+	if err != nil {
+		return 0, err
+	}
+	return a.Generation, nil
+}
+
+// Delete - removes the document
+func (d *Documents) Delete(ctx context.Context, name string) error {
+	return d.cs.DeleteCloudFileCtx(ctx, d.prefix+name)
+}
+
+// Update - reads the document into v (which must be a pointer), calls fn to modify it, then writes it back
+// provided no one else has changed the document in the meantime; if they have, the cycle is repeated. exists is
+// false (and v left at its zero value) when the document does not yet exist. If fn returns an error nothing is
+// written and the error is returned. Returns the generation written. The write is attempted once: if it fails in a
+// way that leaves its outcome unknown (e.g. the response is lost) the error is returned, as retrying it could fail the
+// generation check on its own committed write and apply fn a second time
+func (d *Documents) Update(ctx context.Context, name string, v interface{}, fn func(exists bool) error) (int64, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0, errors.New(`invalid parameter(s)`)
+	}
+	attempts := d.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultUpdateAttempts
+	}
+	var err error
+	for n := 1; n <= attempts; n++ {
+		// content from a previous attempt must not leak into this one
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		gen, e := d.Get(ctx, name, v)
+		if e != nil && !errors.Is(e, ErrNotFound) {
+			return 0, e
+		}
+		if err = fn(e == nil); err != nil {
+			return 0, err
+		}
+		if gen, err = d.putIf(ctx, name, v, gen, true); !errors.Is(err, ErrPrecondition) {
+			return gen, err
+		}
+		if !sleepCtx(ctx, time.Duration(rand.Int63n(int64(n)*int64(20*time.Millisecond)))) {
+			return 0, ctx.Err()
+		}
+	}
+	return 0, err
+}
+
+// sleepCtx - waits for d, returning false if ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
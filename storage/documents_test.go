@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/storagetest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testDoc struct {
+	Title string
+	Count int
+	Tags  []string `json:",omitempty"`
+}
+
+func Test_Documents(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	docs := cs.Documents(testPath + `docs/`)
+	defer cs.DeleteCloudFile(testPath + `docs/a.json`)
+
+	var d testDoc
+	if _, e := docs.Get(ctx, `a.json`, &d); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound, got`, e)
+	}
+	g1, e := docs.Put(ctx, `a.json`, testDoc{Title: `<b>this & that</b>`, Tags: []string{`x`}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, _ := ReadObject(ctx, cs, testPath+`docs/a.json`)
+	if !strings.Contains(string(b), `<b>this & that</b>`) {
+		t.Errorf(`expected unescaped html, got %s`, b)
+	}
+	if g, e := docs.Get(ctx, `a.json`, &d); e != nil || g != g1 || d.Title != `<b>this & that</b>` {
+		t.Error(`unexpected document`, d, g, e)
+	}
+	if _, e = docs.PutIf(ctx, `a.json`, d, 0); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition, got`, e)
+	}
+
+	// concurrent updates are all applied, content does not carry over between attempts
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var u testDoc
+			if _, e := docs.Update(ctx, `a.json`, &u, func(exists bool) error {
+				if !exists {
+					return errors.New(`expected document to exist`)
+				}
+				u.Count++
+				u.Tags = nil
+				return nil
+			}); e != nil {
+				t.Error(e)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, e = docs.Get(ctx, `a.json`, &d); e != nil || d.Count != 5 {
+		t.Errorf(`expected count of 5, got %d %v`, d.Count, e)
+	}
+
+	stop := errors.New(`stop`)
+	if _, e = docs.Update(ctx, `a.json`, &d, func(bool) error { return stop }); e != stop {
+		t.Error(`expected error from fn, got`, e)
+	}
+	if e = docs.Delete(ctx, `a.json`); e != nil {
+		t.Error(e)
+	}
+}
+
+// lostResponseTransport - the first request matching match reaches the server, but its response is replaced by
+// a server error
+type lostResponseTransport struct {
+	lost  int32
+	match func(r *http.Request) bool
+	base  http.RoundTripper
+}
+
+func (lt *lostResponseTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := lt.base.RoundTrip(r)
+	if err != nil || !lt.match(r) || !atomic.CompareAndSwapInt32(&lt.lost, 0, 1) {
+		return res, err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return &http.Response{StatusCode: http.StatusServiceUnavailable, Status: `503 Service Unavailable`,
+		Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(``)), Request: r}, nil
+}
+
+func Test_DocumentsLostResponse(t *testing.T) {
+	srv := storagetest.NewServer(`docs`)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	lt := &lostResponseTransport{lost: 1, base: emulatorTransport{host: u.Host, base: http.DefaultTransport},
+		match: func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, `/upload/`) }}
+	ctx := context.Background()
+	st, e := NewCStoreWith(ctx, `docs`, WithEmulator(srv.URL), WithHTTPClient(&http.Client{Transport: lt}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer st.Close()
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+	docs := st.Documents(``)
+	if _, e = docs.Put(ctx, `c.json`, testDoc{Count: 1}); e != nil {
+		t.Fatal(e)
+	}
+
+	// the increment is committed but reported as failed, it must not be applied again
+	atomic.StoreInt32(&lt.lost, 0)
+	calls := 0
+	var d testDoc
+	if _, e = docs.Update(ctx, `c.json`, &d, func(bool) error {
+		calls++
+		d.Count++
+		return nil
+	}); e == nil {
+		t.Error(`expected the lost response to be reported`)
+	}
+	if calls != 1 {
+		t.Error(`expected fn to be called once, got`, calls)
+	}
+	if _, e = docs.Get(ctx, `c.json`, &d); e != nil || d.Count != 2 {
+		t.Errorf(`expected count of 2, got %d %v`, d.Count, e)
+	}
+}
@@ -0,0 +1,395 @@
+package storage
+
+/*
+	client side envelope encryption for ObjectStore content
+	each object is encrypted with its own random AES-256 data key, which is stored (wrapped by a key encryption key
+	taken from the secrets package) in a header at the start of the object. The content follows as a sequence of
+	AES-GCM sealed chunks, so objects of any size can be encrypted and decrypted as a stream, and truncation,
+	reordering or modification of chunks (or of the header, which is authenticated with every chunk) is detected
+*/
+import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/secrets"
+	"io"
+	"time"
+)
+
+const (
+	encryptionMagic     = `GUE1`
+	defaultChunkSize    = 64 << 10
+	encryptionScheme    = `aes256-gcm-envelope-v1`
+	MetadataKeyID       = `encryption-key-id`
+	MetadataKeyScheme   = `encryption-scheme`
+	maxEncryptionHeader = 4096
+	maxChunkSize        = 1 << 24
+)
+
+// ErrUnknownKey - the object was encrypted with a key encryption key that is not in the KeyRing
+var ErrUnknownKey = errors.New(`storage: unknown encryption key`)
+
+// ErrNotEncrypted - the object does not hold content written by an EncryptedStore
+var ErrNotEncrypted = errors.New(`storage: object is not encrypted`)
+
+// KeyRing - the key encryption keys, identified by name. New objects use the current key, existing objects are
+// decrypted with whichever key they were written with, so keys can be rotated by adding a new current key
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing - keys are 32 byte (AES-256) keys by id, current must be one of them
+func NewKeyRing(current string, keys map[string][]byte) (*KeyRing, error) {
+	kr := &KeyRing{current: current, keys: make(map[string][]byte, len(keys))}
+	for id, k := range keys {
+		if len(k) != 32 {
+			return nil, errors.New(`key encryption key must be 32 bytes: ` + id)
+		}
+		kr.keys[id] = k
+	}
+	if _, ok := kr.keys[current]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return kr, nil
+}
+
+// KeyRingFromSecrets - each of ids names a secrets entry holding a base64 encoded 32 byte key, the first is current
+func KeyRingFromSecrets(s *secrets.Secrets, ids ...string) (*KeyRing, error) {
+	if s == nil || len(ids) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	keys := make(map[string][]byte, len(ids))
+	for _, id := range ids {
+		if !s.KeyExists(id) {
+			return nil, errors.New(`secret not found: ` + id)
+		}
+		k, err := base64.StdEncoding.DecodeString(s.GetString(id))
+		if err != nil {
+			return nil, errors.New(`secret is not base64 encoded: ` + id)
+		}
+		keys[id] = k
+	}
+	return NewKeyRing(ids[0], keys)
+}
+
+// Current - id of the key used for new objects
+func (kr *KeyRing) Current() string {
+	return kr.current
+}
+
+// gcm - an AES-GCM cipher for key
+func gcm(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// wrap - seals a data key with the current key encryption key
+func (kr *KeyRing) wrap(dek []byte) (string, []byte, error) {
+	a, err := gcm(kr.keys[kr.current])
+	if err != nil {
+		return ``, nil, err
+	}
+	nonce := make([]byte, a.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return ``, nil, err
+	}
+	return kr.current, a.Seal(nonce, nonce, dek, []byte(kr.current)), nil
+}
+
+// unwrap - opens a data key sealed with the key encryption key id
+func (kr *KeyRing) unwrap(id string, wrapped []byte) ([]byte, error) {
+	k, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	a, err := gcm(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < a.NonceSize() {
+		return nil, ErrNotEncrypted
+	}
+	return a.Open(nil, wrapped[:a.NonceSize()], wrapped[a.NonceSize():], []byte(id))
+}
+
+// envelopeHeader - stored (as JSON) at the start of each encrypted object
+type envelopeHeader struct {
+	KeyID       string `json:"kid"`
+	WrappedKey  []byte `json:"wk"`
+	ChunkSize   int    `json:"cs"`
+	NoncePrefix []byte `json:"np"`
+}
+
+// chunkNonce - prefix | chunk counter | final chunk flag
+func chunkNonce(prefix []byte, n uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:7])
+	binary.BigEndian.PutUint32(nonce[7:11], n)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptingWriter - seals content written to it in chunks, Close must be called to write the final chunk
+type encryptingWriter struct {
+	dest   io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	aad    []byte
+	buf    []byte
+	size   int
+	n      uint32
+}
+
+// newEncryptingWriter - writes the header for a new data key to dest
+func newEncryptingWriter(dest io.Writer, kr *KeyRing, chunkSize int) (*encryptingWriter, error) {
+	dek := make([]byte, 32)
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	id, wrapped, err := kr.wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	a, err := gcm(dek)
+	if err != nil {
+		return nil, err
+	}
+	h, err := json.Marshal(envelopeHeader{KeyID: id, WrappedKey: wrapped, ChunkSize: chunkSize, NoncePrefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, len(encryptionMagic)+2, len(encryptionMagic)+2+len(h))
+	copy(hdr, encryptionMagic)
+	binary.BigEndian.PutUint16(hdr[len(encryptionMagic):], uint16(len(h)))
+	hdr = append(hdr, h...)
+	if _, err = dest.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{dest: dest, aead: a, prefix: prefix, aad: hdr, size: chunkSize,
+		buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, as the last chunk must be flagged as final
+		if len(ew.buf) == ew.size {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):ew.size], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptingWriter) seal(final bool) error {
+	c := ew.aead.Seal(nil, chunkNonce(ew.prefix, ew.n, final), ew.buf, ew.aad)
+	ew.n++
+	ew.buf = ew.buf[:0]
+	_, err := ew.dest.Write(c)
+	return err
+}
+
+// Close - writes the final chunk, it does not close the destination
+func (ew *encryptingWriter) Close() error {
+	return ew.seal(true)
+}
+
+// decryptingReader - opens the chunks of an encrypted object as they are read
+type decryptingReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	prefix []byte
+	aad    []byte
+	chunk  []byte
+	plain  []byte
+	n      uint32
+	done   bool
+}
+
+// newDecryptingReader - reads the header from r, unwrapping the data key. The header is not trusted until the first
+// chunk is opened, so the chunk size it gives is bounded before the chunk buffer is allocated
+func newDecryptingReader(r io.ReadCloser, kr *KeyRing) (*decryptingReader, error) {
+	br := bufio.NewReader(r)
+	pre := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(br, pre); err != nil || string(pre[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, ErrNotEncrypted
+	}
+	hl := int(binary.BigEndian.Uint16(pre[len(encryptionMagic):]))
+	if hl > maxEncryptionHeader {
+		return nil, ErrNotEncrypted
+	}
+	hb := make([]byte, hl)
+	if _, err := io.ReadFull(br, hb); err != nil {
+		return nil, ErrNotEncrypted
+	}
+	var h envelopeHeader
+	if err := json.Unmarshal(hb, &h); err != nil || h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize ||
+		len(h.NoncePrefix) != 7 {
+		return nil, ErrNotEncrypted
+	}
+	dek, err := kr.unwrap(h.KeyID, h.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	a, err := gcm(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{src: br, closer: r, aead: a, prefix: h.NoncePrefix, aad: append(pre, hb...),
+		chunk: make([]byte, h.ChunkSize+a.Overhead())}, nil
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.src, dr.chunk)
+		final := false
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		} else if _, e := dr.src.Peek(1); e == io.EOF {
+			final = true
+		}
+		dr.plain, err = dr.aead.Open(dr.chunk[:0], chunkNonce(dr.prefix, dr.n, final), dr.chunk[:n], dr.aad)
+		if err != nil {
+			return 0, errors.New(`storage: encrypted content is corrupt or truncated`)
+		}
+		dr.n++
+		dr.done = final
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptingReader) Close() error {
+	return dr.closer.Close()
+}
+
+// EncryptedStore - an ObjectStore that encrypts content before it is passed to the underlying store, and decrypts
+// it when read. Object attributes are those of the stored (encrypted) content, so Size includes the encryption overhead
+type EncryptedStore struct {
+	store     ObjectStore
+	keys      *KeyRing
+	chunkSize int
+}
+
+// NewEncryptedStore - wraps st (typically a CStore) so content is encrypted using keys
+func NewEncryptedStore(st ObjectStore, keys *KeyRing) (*EncryptedStore, error) {
+	if st == nil || keys == nil {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	return &EncryptedStore{store: st, keys: keys, chunkSize: defaultChunkSize}, nil
+}
+
+// Store - the underlying store, holding the encrypted content
+func (es *EncryptedStore) Store() ObjectStore {
+	return es.store
+}
+
+// List - ObjectStore implementation
+func (es *EncryptedStore) List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error) {
+	return es.store.List(ctx, prefix)
+}
+
+// Attrs - ObjectStore implementation
+func (es *EncryptedStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	return es.store.Attrs(ctx, name)
+}
+
+// NewReader - ObjectStore implementation, content is decrypted as it is read. The size returned is that of the
+// stored content. A read error is returned if the content has been tampered with
+func (es *EncryptedStore) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	r, size, err := es.store.NewReader(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	dr, err := newDecryptingReader(r, es.keys)
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	return dr, size, nil
+}
+
+// Write - ObjectStore implementation
+func (es *EncryptedStore) Write(ctx context.Context, name string, content []byte, contentType string) error {
+	_, err := es.WriteFrom(ctx, name, bytes.NewReader(content), &WriteOptions{ContentType: contentType})
+	return err
+}
+
+// WriteFrom - encrypts the content of r as it is written. When the underlying store is a CStore the id of the key
+// encryption key is recorded in the object metadata. opts.Gzip is applied to the encrypted content, which will not
+// compress, so it is ignored
+func (es *EncryptedStore) WriteFrom(ctx context.Context, name string, r io.Reader, opts *WriteOptions) (int64, error) {
+	wo := WriteOptions{}
+	if opts != nil {
+		wo = *opts
+	}
+	wo.Gzip = false
+	wo.Metadata = map[string]string{}
+	for k, v := range opts.metadata() {
+		wo.Metadata[k] = v
+	}
+	wo.Metadata[MetadataKeyID] = es.keys.current
+	wo.Metadata[MetadataKeyScheme] = encryptionScheme
+
+	var n int64
+	err := writeStream(ctx, es.store, name, &wo, func(w io.Writer) error {
+		ew, err := newEncryptingWriter(w, es.keys, es.chunkSize)
+		if err != nil {
+			return err
+		}
+		if n, err = io.Copy(ew, r); err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+	return n, err
+}
+
+// Delete - ObjectStore implementation
+func (es *EncryptedStore) Delete(ctx context.Context, name string) error {
+	return es.store.Delete(ctx, name)
+}
+
+// Copy - ObjectStore implementation. Copies to another EncryptedStore keep the content encrypted (the destination
+// must hold the same key encryption key), otherwise the content is decrypted into dest
+func (es *EncryptedStore) Copy(ctx context.Context, src string, dest ObjectStore, destName string) error {
+	if d, ok := dest.(*EncryptedStore); ok {
+		return es.store.Copy(ctx, src, d.store, destName)
+	}
+	return copyObject(ctx, es, src, dest, destName)
+}
+
+// SignedURL - ObjectStore implementation, not supported as the holder of the url could not decrypt the content
+func (es *EncryptedStore) SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error) {
+	return ``, errors.New(`storage: signed urls are not supported for encrypted objects`)
+}
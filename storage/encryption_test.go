@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/cambefus/gcp_go_utils/secrets"
+	"math/rand"
+	"testing"
+)
+
+func testKeyRing(t *testing.T, ids ...string) *KeyRing {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[len(id)-1:]), 32)
+	}
+	kr, err := NewKeyRing(ids[0], keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`enc`)
+	es, err := NewEncryptedStore(ms, testKeyRing(t, `k1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.chunkSize = 100
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	// sizes either side of the chunk boundaries, including empty content
+	for _, n := range []int{0, 1, 99, 100, 101, 200, 1000} {
+		if err = es.Write(ctx, `obj`, data[:n], `application/octet-stream`); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := ReadObject(ctx, ms, `obj`)
+		if n >= 16 && bytes.Contains(raw, data[:n]) {
+			t.Errorf(`%d: stored content is not encrypted`, n)
+		}
+		b, e := ReadObject(ctx, es, `obj`)
+		if e != nil || !bytes.Equal(b, data[:n]) {
+			t.Errorf(`%d: round trip failed %v`, n, e)
+		}
+	}
+
+	// tampering and truncation are detected
+	raw, _ := ReadObject(ctx, ms, `obj`)
+	bad := append([]byte{}, raw...)
+	bad[len(bad)-50] ^= 1
+	_ = ms.Write(ctx, `bad`, bad, ``)
+	if _, e := ReadObject(ctx, es, `bad`); e == nil {
+		t.Error(`expected modified content to fail`)
+	}
+	_ = ms.Write(ctx, `short`, raw[:len(raw)-116], ``)
+	if _, e := ReadObject(ctx, es, `short`); e == nil {
+		t.Error(`expected truncated content to fail`)
+	}
+	_ = ms.Write(ctx, `plain`, data, ``)
+	if _, _, e := es.NewReader(ctx, `plain`); e != ErrNotEncrypted {
+		t.Error(`expected ErrNotEncrypted, got`, e)
+	}
+
+	// copies to another encrypted store stay encrypted, copies elsewhere are decrypted
+	other := NewMemStore(`other`)
+	if err = es.Copy(ctx, `obj`, other, `dec`); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ReadObject(ctx, other, `dec`); !bytes.Equal(b, data) {
+		t.Error(`expected decrypted copy`)
+	}
+	eo, _ := NewEncryptedStore(other, testKeyRing(t, `k1`))
+	if err = es.Copy(ctx, `obj`, eo, `enc`); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ReadObject(ctx, eo, `enc`); !bytes.Equal(b, data) {
+		t.Error(`expected encrypted copy to decrypt`)
+	}
+
+	// after rotation old objects remain readable, a ring without the key cannot read them
+	rotated, _ := NewEncryptedStore(ms, testKeyRing(t, `k2`, `k1`))
+	if b, e := ReadObject(ctx, rotated, `obj`); e != nil || !bytes.Equal(b, data) {
+		t.Error(`expected rotated ring to read old object`, e)
+	}
+	other2, _ := NewEncryptedStore(ms, testKeyRing(t, `k2`))
+	if _, _, e := other2.NewReader(ctx, `obj`); e != ErrUnknownKey {
+		t.Error(`expected ErrUnknownKey, got`, e)
+	}
+}
+
+// reheader - raw encrypted content with its header replaced by one edited with fn, extra is appended to the JSON
+func reheader(t *testing.T, raw []byte, fn func(h *envelopeHeader), extra string) []byte {
+	hl := int(binary.BigEndian.Uint16(raw[len(encryptionMagic):]))
+	start := len(encryptionMagic) + 2
+	var h envelopeHeader
+	if err := json.Unmarshal(raw[start:start+hl], &h); err != nil {
+		t.Fatal(err)
+	}
+	fn(&h)
+	hb, _ := json.Marshal(h)
+	hb = append(hb, extra...)
+	out := append([]byte(encryptionMagic), 0, 0)
+	binary.BigEndian.PutUint16(out[len(encryptionMagic):], uint16(len(hb)))
+	out = append(out, hb...)
+	return append(out, raw[start+hl:]...)
+}
+
+func TestEncryptedStoreHeader(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`enc`)
+	es, _ := NewEncryptedStore(ms, testKeyRing(t, `k1`))
+	es.chunkSize = 100
+	data := make([]byte, 250)
+	rand.Read(data)
+	if err := es.Write(ctx, `obj`, data, ``); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ReadObject(ctx, ms, `obj`)
+
+	// an unchanged header still decrypts
+	_ = ms.Write(ctx, `same`, reheader(t, raw, func(h *envelopeHeader) {}, ``), ``)
+	if b, e := ReadObject(ctx, es, `same`); e != nil || !bytes.Equal(b, data) {
+		t.Error(`expected rewritten header to decrypt`, e)
+	}
+	// an unbounded chunk size is rejected before anything is allocated
+	_ = ms.Write(ctx, `huge`, reheader(t, raw, func(h *envelopeHeader) { h.ChunkSize = 1 << 40 }, ``), ``)
+	if _, _, e := es.NewReader(ctx, `huge`); e != ErrNotEncrypted {
+		t.Error(`expected ErrNotEncrypted, got`, e)
+	}
+	// any other change to the header fails authentication of the content
+	_ = ms.Write(ctx, `edited`, reheader(t, raw, func(h *envelopeHeader) {}, ` `), ``)
+	if _, e := ReadObject(ctx, es, `edited`); e == nil {
+		t.Error(`expected edited header to fail`)
+	}
+	_ = ms.Write(ctx, `resized`, reheader(t, raw, func(h *envelopeHeader) { h.ChunkSize = 100 << 10 }, ``), ``)
+	if _, e := ReadObject(ctx, es, `resized`); e == nil {
+		t.Error(`expected edited header to fail`)
+	}
+}
+
+func TestKeyRingFromSecrets(t *testing.T) {
+	k := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	s, err := secrets.Parse([]byte(`{"ConfigName": "t", "Records": [{"Key": "kek1", "Value": "` + k + `"},
+		{"Key": "short", "Value": "AAAA"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := KeyRingFromSecrets(s, `kek1`)
+	if err != nil || kr.Current() != `kek1` {
+		t.Error(`expected key ring`, err)
+	}
+	if _, err = KeyRingFromSecrets(s, `short`); err == nil {
+		t.Error(`expected short key to fail`)
+	}
+	if _, err = KeyRingFromSecrets(s, `missing`); err == nil {
+		t.Error(`expected missing key to fail`)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+/*
+	typed errors returned by CStore operations
+*/
+import (
+	"cloud.google.com/go/storage"
+	"errors"
+	"google.golang.org/api/googleapi"
+	"net/http"
+)
+
+// ErrPrecondition - matched (via errors.Is) by errors returned when a generation / metageneration precondition is not met
+var ErrPrecondition = errors.New(`storage: precondition failed`)
+
+// ErrNotFound - matched (via errors.Is) by errors returned when the object or bucket does not exist.
+// Such errors also match storage.ErrObjectNotExist or storage.ErrBucketNotExist
+var ErrNotFound = errors.New(`storage: not found`)
+
+// ErrPermission - matched (via errors.Is) by errors returned when the credentials are missing or lack permission
+var ErrPermission = errors.New(`storage: permission denied`)
+
+// ErrRateLimited - matched (via errors.Is) by errors returned when the request was rejected due to rate limits
+var ErrRateLimited = errors.New(`storage: rate limited`)
+
+// Error - a GCS error on Object (which may be a prefix, or empty for bucket level operations), classified by Kind.
+// errors.Is matches both Kind and the underlying error
+type Error struct {
+	Object string
+	Kind   error
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + `: ` + e.Object + `: ` + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// notFound - the error reported for a missing object
+func notFound(object string) error {
+	return &Error{Object: object, Kind: ErrNotFound, Err: storage.ErrObjectNotExist}
+}
+
+// classify - converts a GCS error on object into a typed error, errors that are already typed or
+// that have no corresponding type are returned unchanged
+func classify(object string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var te *Error
+	var pe *PreconditionError
+	if errors.As(err, &te) || errors.As(err, &pe) {
+		return err
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return &Error{Object: object, Kind: ErrNotFound, Err: err}
+	}
+	var ge *googleapi.Error
+	if !errors.As(err, &ge) {
+		return err
+	}
+	switch ge.Code {
+	case http.StatusNotFound:
+		return &Error{Object: object, Kind: ErrNotFound, Err: err}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &Error{Object: object, Kind: ErrPermission, Err: err}
+	case http.StatusTooManyRequests:
+		return &Error{Object: object, Kind: ErrRateLimited, Err: err}
+	case http.StatusPreconditionFailed, http.StatusNotModified:
+		return &PreconditionError{Object: object, Err: err}
+	}
+	return err
+}
+
+// PreconditionError - the object was changed (or created) by someone else
+type PreconditionError struct {
+	Object string
+	Err    error
+}
+
+func (e *PreconditionError) Error() string {
+	return `storage: precondition failed for ` + e.Object + `: ` + e.Err.Error()
+}
+
+func (e *PreconditionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PreconditionError) Is(target error) bool {
+	return target == ErrPrecondition
+}
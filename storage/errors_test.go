@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"google.golang.org/api/googleapi"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		kind error
+	}{
+		{storage.ErrObjectNotExist, ErrNotFound},
+		{storage.ErrBucketNotExist, ErrNotFound},
+		{&googleapi.Error{Code: 404}, ErrNotFound},
+		{&googleapi.Error{Code: 401}, ErrPermission},
+		{&googleapi.Error{Code: 403}, ErrPermission},
+		{&googleapi.Error{Code: 429}, ErrRateLimited},
+		{&googleapi.Error{Code: 412}, ErrPrecondition},
+	} {
+		e := classify(`a.txt`, c.err)
+		if !errors.Is(e, c.kind) || !errors.Is(e, c.err) {
+			t.Errorf(`expected %v to be classified as %v, got %v`, c.err, c.kind, e)
+		}
+	}
+	e := classify(`a.txt`, &googleapi.Error{Code: 503})
+	for _, k := range []error{ErrNotFound, ErrPermission, ErrRateLimited, ErrPrecondition} {
+		if errors.Is(e, k) {
+			t.Error(`did not expect 503 to be classified as`, k)
+		}
+	}
+	if classify(`a.txt`, nil) != nil {
+		t.Error(`expected nil`)
+	}
+	var te *Error
+	if !errors.As(classify(`a.txt`, storage.ErrObjectNotExist), &te) || te.Object != `a.txt` {
+		t.Error(`expected Error for a.txt`)
+	}
+}
+
+func Test_TypedErrors(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	fn := testPath + `typed.txt`
+	if e := cs.WriteFile(fn, fileContents); e != nil {
+		t.Fatal(e)
+	}
+	defer cs.DeleteCloudFile(fn)
+	a, e := cs.Attrs(ctx, fn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = cs.GetVersionReader(ctx, fn, a.Generation+1); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound for a missing generation, got`, e)
+	}
+	if e = cs.DeleteVersion(ctx, fn, a.Generation+1); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound deleting a missing generation, got`, e)
+	}
+	key := make([]byte, EncryptionKeySize)
+	if _, e = cs.RotateEncryptionKey(ctx, testPath+`missing.txt`, nil, key); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound rotating a missing object, got`, e)
+	}
+
+	missing, e := NewCStoreWith(ctx, cs.BucketName()+`-missing`, WithClient(cs.Client()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = missing.BucketAttrs(ctx); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound for a missing bucket, got`, e)
+	}
+	if _, e = missing.GetLifecycle(ctx); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound for a missing bucket, got`, e)
+	}
+	if e = missing.SetVersioning(ctx, true); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound for a missing bucket, got`, e)
+	}
+	if ok, e := missing.BucketExists(ctx); ok || e != nil {
+		t.Error(`expected bucket not to exist`, e)
+	}
+}
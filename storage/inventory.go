@@ -0,0 +1,280 @@
+package storage
+
+/*
+	usage & inventory reporting
+	object counts and bytes aggregated by prefix, storage class, content type and age, with the largest objects,
+	exported as CSV or JSON to an ObjectStore, or to a database table (e.g. via pgdb)
+*/
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// DefaultAgeBuckets - the upper bounds of the age buckets used when InventoryOptions.AgeBuckets is empty
+var DefaultAgeBuckets = []time.Duration{day, 7 * day, 30 * day, 90 * day, 365 * day}
+
+// InventoryOptions - controls the aggregation of an InventoryReport, zero values use the defaults
+type InventoryOptions struct {
+	// PrefixDepth - the number of "/" separated folder levels objects are grouped by, defaults to 1
+	PrefixDepth int
+	// Largest - the number of largest objects reported, defaults to 10
+	Largest int
+	// AgeBuckets - ascending upper bounds of object age (since creation), older objects fall in a final bucket
+	AgeBuckets []time.Duration
+	// Now - the time ages are measured from, defaults to the current time
+	Now time.Time
+}
+
+// UsageStat - the number of objects and total bytes within a group
+type UsageStat struct {
+	Key     string
+	Objects int64
+	Bytes   int64
+}
+
+// InventoryObject - summary of a single object
+type InventoryObject struct {
+	Name         string
+	Bytes        int64
+	StorageClass string
+	ContentType  string
+	Created      time.Time
+}
+
+// InventoryReport - usage of the objects under a prefix. Groups are ordered by bytes, largest first
+type InventoryReport struct {
+	Prefix         string
+	Generated      time.Time
+	Objects        int64
+	Bytes          int64
+	ByPrefix       []UsageStat
+	ByStorageClass []UsageStat
+	ByContentType  []UsageStat
+	ByAge          []UsageStat
+	Largest        []InventoryObject
+}
+
+// Inventory - reports the usage of the objects in st whose name begins with prefix
+func Inventory(ctx context.Context, st ObjectStore, prefix string, opts InventoryOptions) (*InventoryReport, error) {
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	r := BuildInventory(objects, opts)
+	r.Prefix = prefix
+	return r, nil
+}
+
+// Inventory - see the package level Inventory
+func (cs *CStore) Inventory(ctx context.Context, prefix string, opts InventoryOptions) (*InventoryReport, error) {
+	return Inventory(ctx, cs, prefix, opts)
+}
+
+// BuildInventory - aggregates the attributes of objects, e.g. as returned by GetFileInfo
+func BuildInventory(objects []storage.ObjectAttrs, opts InventoryOptions) *InventoryReport {
+	if opts.PrefixDepth <= 0 {
+		opts.PrefixDepth = 1
+	}
+	if opts.Largest <= 0 {
+		opts.Largest = 10
+	}
+	if len(opts.AgeBuckets) == 0 {
+		opts.AgeBuckets = DefaultAgeBuckets
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	r := &InventoryReport{Generated: opts.Now.UTC()}
+	prefixes := map[string]*UsageStat{}
+	classes := map[string]*UsageStat{}
+	types := map[string]*UsageStat{}
+	ages := map[string]*UsageStat{}
+	for _, oa := range objects {
+		r.Objects++
+		r.Bytes += oa.Size
+		addUsage(prefixes, prefixAtDepth(oa.Name, opts.PrefixDepth), oa.Size)
+		addUsage(classes, orUnspecified(oa.StorageClass), oa.Size)
+		addUsage(types, orUnspecified(oa.ContentType), oa.Size)
+		created := oa.Created
+		if created.IsZero() {
+			created = oa.Updated
+		}
+		addUsage(ages, ageBucket(opts.Now.Sub(created), opts.AgeBuckets), oa.Size)
+		r.Largest = append(r.Largest, InventoryObject{Name: oa.Name, Bytes: oa.Size, StorageClass: oa.StorageClass,
+			ContentType: oa.ContentType, Created: created})
+	}
+	r.ByPrefix = sortedUsage(prefixes)
+	r.ByStorageClass = sortedUsage(classes)
+	r.ByContentType = sortedUsage(types)
+	r.ByAge = sortedUsage(ages)
+	sort.SliceStable(r.Largest, func(i, j int) bool { return r.Largest[i].Bytes > r.Largest[j].Bytes })
+	if len(r.Largest) > opts.Largest {
+		r.Largest = r.Largest[:opts.Largest]
+	}
+	return r
+}
+
+func addUsage(m map[string]*UsageStat, key string, size int64) {
+	u, ok := m[key]
+	if !ok {
+		u = &UsageStat{Key: key}
+		m[key] = u
+	}
+	u.Objects++
+	u.Bytes += size
+}
+
+func sortedUsage(m map[string]*UsageStat) []UsageStat {
+	result := make([]UsageStat, 0, len(m))
+	for _, u := range m {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+func orUnspecified(s string) string {
+	if len(s) == 0 {
+		return `unspecified`
+	}
+	return s
+}
+
+// prefixAtDepth - the folder of name truncated to depth levels, e.g. "a/b/" for "a/b/c/d.txt" at depth 2.
+// Objects not within a folder are grouped under ""
+func prefixAtDepth(name string, depth int) string {
+	parts := strings.Split(name, `/`)
+	parts = parts[:len(parts)-1]
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	if len(parts) == 0 {
+		return ``
+	}
+	return strings.Join(parts, `/`) + `/`
+}
+
+// ageBucket - the label of the first bucket age falls within, e.g. "<7d", or ">=365d" beyond the last
+func ageBucket(age time.Duration, buckets []time.Duration) string {
+	for _, b := range buckets {
+		if age < b {
+			return `<` + durationLabel(b)
+		}
+	}
+	return `>=` + durationLabel(buckets[len(buckets)-1])
+}
+
+func durationLabel(d time.Duration) string {
+	if d%day == 0 {
+		return strconv.FormatInt(int64(d/day), 10) + `d`
+	}
+	return d.String()
+}
+
+// InventoryRow - a single line of an exported report. Dimension is one of total, prefix, storage_class,
+// content_type, age or largest, for the largest objects Key is the object name and Objects is 1
+type InventoryRow struct {
+	Dimension string
+	Key       string
+	Objects   int64
+	Bytes     int64
+}
+
+// Rows - the report flattened into rows, as exported by WriteCSV and ExportSQL
+func (r *InventoryReport) Rows() []InventoryRow {
+	rows := []InventoryRow{{Dimension: `total`, Key: r.Prefix, Objects: r.Objects, Bytes: r.Bytes}}
+	add := func(dim string, stats []UsageStat) {
+		for _, u := range stats {
+			rows = append(rows, InventoryRow{Dimension: dim, Key: u.Key, Objects: u.Objects, Bytes: u.Bytes})
+		}
+	}
+	add(`prefix`, r.ByPrefix)
+	add(`storage_class`, r.ByStorageClass)
+	add(`content_type`, r.ByContentType)
+	add(`age`, r.ByAge)
+	for _, o := range r.Largest {
+		rows = append(rows, InventoryRow{Dimension: `largest`, Key: o.Name, Objects: 1, Bytes: o.Bytes})
+	}
+	return rows
+}
+
+// WriteCSV - writes the report rows as CSV with a header line
+func (r *InventoryReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{`dimension`, `key`, `objects`, `bytes`})
+	for _, row := range r.Rows() {
+		_ = cw.Write([]string{row.Dimension, row.Key, strconv.FormatInt(row.Objects, 10), strconv.FormatInt(row.Bytes, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON - writes the report as an indented JSON document
+func (r *InventoryReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent(``, `  `)
+	return enc.Encode(r)
+}
+
+// SaveTo - writes the report to the object name in st, as CSV if name ends in .csv, otherwise as JSON
+func (r *InventoryReport) SaveTo(ctx context.Context, st ObjectStore, name string) error {
+	var buf bytes.Buffer
+	var err error
+	ct := `application/json`
+	if strings.EqualFold(path.Ext(name), `.csv`) {
+		ct = `text/csv`
+		err = r.WriteCSV(&buf)
+	} else {
+		err = r.WriteJSON(&buf)
+	}
+	if err != nil {
+		return err
+	}
+	return st.Write(ctx, name, buf.Bytes(), ct)
+}
+
+// SQLExecutor - executes a statement that returns no rows, satisfied by *pgdb.DBPool
+type SQLExecutor interface {
+	Execute(q string, args ...interface{}) (int, error)
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ExportSQL - appends the report rows to table (created if it does not exist), each row carrying the report
+// prefix & generated time so that successive reports may share a table. Statements use postgres placeholders
+func (r *InventoryReport) ExportSQL(db SQLExecutor, table string) error {
+	if db == nil || !sqlIdentifier.MatchString(table) {
+		return errors.New(`invalid parameter(s)`)
+	}
+	_, err := db.Execute(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (generated timestamptz NOT NULL, prefix text NOT NULL, `+
+		`dimension text NOT NULL, key text NOT NULL, objects bigint NOT NULL, bytes bigint NOT NULL)`, table))
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`INSERT INTO %s (generated, prefix, dimension, key, objects, bytes) VALUES ($1, $2, $3, $4, $5, $6)`, table)
+	for _, row := range r.Rows() {
+		if _, err = db.Execute(q, r.Generated, r.Prefix, row.Dimension, row.Key, row.Objects, row.Bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"github.com/cambefus/gcp_go_utils/pgdb"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ SQLExecutor = (*pgdb.DBPool)(nil)
+
+type recordingExecutor struct {
+	statements []string
+	args       [][]interface{}
+}
+
+func (re *recordingExecutor) Execute(q string, args ...interface{}) (int, error) {
+	re.statements = append(re.statements, q)
+	re.args = append(re.args, args)
+	return 1, nil
+}
+
+func TestBuildInventory(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	objects := []storage.ObjectAttrs{
+		{Name: `top.txt`, Size: 5, StorageClass: `STANDARD`, ContentType: `text/plain`, Created: now.Add(-time.Hour)},
+		{Name: `a/b/c/big.bin`, Size: 100, StorageClass: `NEARLINE`, Created: now.Add(-40 * day)},
+		{Name: `a/b/x.csv`, Size: 20, StorageClass: `STANDARD`, ContentType: `text/csv`, Created: now.Add(-400 * day)},
+		{Name: `a/y.csv`, Size: 10, StorageClass: `STANDARD`, ContentType: `text/csv`, Created: now.Add(-2 * day)},
+	}
+	r := BuildInventory(objects, InventoryOptions{PrefixDepth: 2, Largest: 2, Now: now})
+	if r.Objects != 4 || r.Bytes != 135 {
+		t.Error(`unexpected totals`, r.Objects, r.Bytes)
+	}
+	expect := func(label string, got []UsageStat, want ...UsageStat) {
+		if len(got) != len(want) {
+			t.Errorf(`%s: expected %v, got %v`, label, want, got)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf(`%s: expected %v, got %v`, label, want, got)
+				return
+			}
+		}
+	}
+	expect(`prefix`, r.ByPrefix, UsageStat{`a/b/`, 2, 120}, UsageStat{`a/`, 1, 10}, UsageStat{``, 1, 5})
+	expect(`class`, r.ByStorageClass, UsageStat{`NEARLINE`, 1, 100}, UsageStat{`STANDARD`, 3, 35})
+	expect(`type`, r.ByContentType, UsageStat{`unspecified`, 1, 100}, UsageStat{`text/csv`, 2, 30}, UsageStat{`text/plain`, 1, 5})
+	expect(`age`, r.ByAge, UsageStat{`<90d`, 1, 100}, UsageStat{`>=365d`, 1, 20}, UsageStat{`<7d`, 1, 10}, UsageStat{`<1d`, 1, 5})
+	if len(r.Largest) != 2 || r.Largest[0].Name != `a/b/c/big.bin` || r.Largest[1].Name != `a/b/x.csv` {
+		t.Errorf(`unexpected largest %+v`, r.Largest)
+	}
+
+	ms := NewMemStore(`reports`)
+	ctx := context.Background()
+	if e := r.SaveTo(ctx, ms, `usage.csv`); e != nil {
+		t.Fatal(e)
+	}
+	b, _ := ReadObject(ctx, ms, `usage.csv`)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1+len(r.Rows()) || lines[0] != `dimension,key,objects,bytes` || lines[1] != `total,,4,135` {
+		t.Errorf(`unexpected csv %s`, b)
+	}
+	if e := r.SaveTo(ctx, ms, `usage.json`); e != nil {
+		t.Fatal(e)
+	}
+	b, _ = ReadObject(ctx, ms, `usage.json`)
+	var r2 InventoryReport
+	if e := json.Unmarshal(b, &r2); e != nil || r2.Bytes != 135 || len(r2.ByAge) != 4 {
+		t.Error(`unexpected json`, e, string(b))
+	}
+
+	var ex recordingExecutor
+	if e := r.ExportSQL(&ex, `usage; drop table x`); e == nil {
+		t.Error(`expected invalid table name to be rejected`)
+	}
+	if e := r.ExportSQL(&ex, `reports.usage`); e != nil {
+		t.Fatal(e)
+	}
+	if len(ex.statements) != 1+len(r.Rows()) || !strings.HasPrefix(ex.statements[0], `CREATE TABLE IF NOT EXISTS reports.usage`) {
+		t.Errorf(`unexpected statements %v`, ex.statements)
+	}
+	if a := ex.args[len(ex.args)-1]; a[2] != `largest` || a[3] != `a/b/x.csv` || a[5] != int64(20) {
+		t.Errorf(`unexpected args %v`, a)
+	}
+}
+
+func Test_Inventory(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	p := testPath + `inventory/`
+	for _, fn := range []string{`one/a.txt`, `one/b.txt`, `two/c.json`} {
+		if e := cs.WriteCloudFile(p+fn, []byte(fileContents), ``); e != nil {
+			t.Fatal(e)
+		}
+		defer cs.DeleteCloudFile(p + fn)
+	}
+	r, e := cs.Inventory(ctx, p, InventoryOptions{PrefixDepth: 3})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if r.Objects != 3 || r.Bytes != 3*int64(len(fileContents)) || len(r.ByPrefix) != 2 || r.ByPrefix[0].Key != p+`one/` {
+		t.Errorf(`unexpected report %+v`, r)
+	}
+	var buf bytes.Buffer
+	if e = r.WriteCSV(&buf); e != nil || !strings.Contains(buf.String(), `content_type,application/json,1,`) {
+		t.Error(`unexpected csv`, e, buf.String())
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+/*
+	paginated and hierarchical listing of CStore objects
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"google.golang.org/api/iterator"
+	"regexp"
+	"strings"
+)
+
+// ListOptions - controls which objects are returned by ListPage / ListAll
+type ListOptions struct {
+	// Prefix - only objects whose name begins with Prefix are returned
+	Prefix string
+	// Delimiter - when set (typically "/") objects below the next delimiter are not returned,
+	// instead their common prefix is reported once in ListPage.Prefixes, i.e. "folders"
+	Delimiter string
+	// StartOffset / EndOffset - restrict results to names >= StartOffset and < EndOffset
+	StartOffset string
+	EndOffset   string
+	// Pattern - optional glob the object name, relative to Prefix, must match. * and ? do not match '/', ** matches
+	// anything, e.g. "*.csv" with Prefix "reports/" matches reports/a.csv but not reports/2021/b.csv.
+	// Matching is performed client side, so pages may hold fewer than PageSize objects
+	Pattern string
+	// PageSize - maximum number of objects (and prefixes) per page, zero for the GCS maximum of 1000
+	PageSize int
+	// PageToken - resume from the page identified by a previous ListPage.NextPageToken
+	PageToken string
+	// Versions - include every generation of each object, noncurrent generations have Deleted set
+	Versions bool
+}
+
+// ListPage - a single page of listing results
+type ListPage struct {
+	Objects  []storage.ObjectAttrs
+	Prefixes []string
+	// NextPageToken - empty when there are no further pages
+	NextPageToken string
+}
+
+// query - converts the options to a storage query
+func (lo *ListOptions) query() *storage.Query {
+	q := &storage.Query{Prefix: lo.Prefix, Delimiter: lo.Delimiter, StartOffset: lo.StartOffset, EndOffset: lo.EndOffset,
+		Versions: lo.Versions}
+	// the literal start of the pattern narrows the listing
+	q.Prefix += globPrefix(lo.Pattern)
+	return q
+}
+
+// defaultPageSize - the maximum page size supported by GCS
+const defaultPageSize = 1000
+
+// ListPage - returns a single page of objects / prefixes, pass NextPageToken back in opts.PageToken for the next page
+func (cs *CStore) ListPage(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	var re *regexp.Regexp
+	if len(opts.Pattern) > 0 {
+		var err error
+		if re, err = globRegexp(opts.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	size := opts.PageSize
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	var items []*storage.ObjectAttrs
+	var token string
+	err := cs.retry(ctx, opts.Prefix, func(ctx context.Context) error {
+		items = nil
+		var err error
+		it := cs.bucket.Objects(ctx, opts.query())
+		token, err = iterator.NewPager(it, size, opts.PageToken).NextPage(&items)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &ListPage{NextPageToken: token}
+	for _, oa := range items {
+		if len(oa.Prefix) > 0 {
+			result.Prefixes = append(result.Prefixes, oa.Prefix)
+		} else if re == nil || re.MatchString(strings.TrimPrefix(oa.Name, opts.Prefix)) {
+			result.Objects = append(result.Objects, *oa)
+		}
+	}
+	return result, nil
+}
+
+// ListAll - walks every page matching opts (PageToken is used as the starting point), combining the results
+func (cs *CStore) ListAll(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	result := new(ListPage)
+	for {
+		p, err := cs.ListPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Objects = append(result.Objects, p.Objects...)
+		result.Prefixes = append(result.Prefixes, p.Prefixes...)
+		if len(p.NextPageToken) == 0 {
+			return result, nil
+		}
+		opts.PageToken = p.NextPageToken
+	}
+}
+
+// ListDir - the immediate contents of a "folder", returns the sub folder prefixes and the objects directly within path
+func (cs *CStore) ListDir(ctx context.Context, path string) ([]string, []storage.ObjectAttrs, error) {
+	p, err := cs.ListAll(ctx, ListOptions{Prefix: path, Delimiter: `/`})
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Prefixes, p.Objects, nil
+}
+
+// GetFilesMatching - returns list of files from the specified path where the file name, relative to path,
+// matches the glob pattern (see ListOptions.Pattern)
+func (cs *CStore) GetFilesMatching(path string, pattern string) ([]string, error) {
+	return cs.GetFilesMatchingCtx(context.Background(), path, pattern)
+}
+
+// GetFilesMatchingCtx - as GetFilesMatching, bounded by ctx
+func (cs *CStore) GetFilesMatchingCtx(ctx context.Context, path string, pattern string) ([]string, error) {
+	p, err := cs.ListAll(ctx, ListOptions{Prefix: path, Pattern: pattern})
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, oa := range p.Objects {
+		result = append(result, oa.Name)
+	}
+	return result, nil
+}
+
+// MatchGlob - reports whether name matches the glob pattern, see ListOptions.Pattern
+func MatchGlob(pattern, name string) (bool, error) {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(name), nil
+}
+
+// globPrefix - the literal portion of pattern preceding the first wildcard
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globRegexp - converts a glob into an anchored regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString(`^`)
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" also matches no directories at all
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString(`(?:.*/)?`)
+				} else {
+					sb.WriteString(`.*`)
+				}
+			} else {
+				sb.WriteString(`[^/]*`)
+			}
+		case '?':
+			sb.WriteString(`[^/]`)
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				return nil, errors.New(`unterminated [ in pattern: ` + pattern)
+			}
+			class := pattern[i+1 : i+1+j]
+			// a negated class must not match '/' either, only ** crosses folders
+			if strings.HasPrefix(class, `!`) {
+				class = `^/` + class[1:]
+			}
+			sb.WriteString(`[` + strings.ReplaceAll(class, `\`, `\\`) + `]`)
+			i += j + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				c = pattern[i]
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString(`$`)
+	return regexp.Compile(sb.String())
+}
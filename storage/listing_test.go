@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{`*.txt`, `f1.txt`, true},
+		{`*.txt`, `dir/f1.txt`, false},
+		{`dir/*.txt`, `dir/f1.txt`, true},
+		{`**.txt`, `a/b/f1.txt`, true},
+		{`a/**/f1.txt`, `a/f1.txt`, true},
+		{`a/**/f1.txt`, `a/b/c/f1.txt`, true},
+		{`f?.json`, `f2.json`, true},
+		{`f?.json`, `f22.json`, false},
+		{`f[12].txt`, `f2.txt`, true},
+		{`f[!12].txt`, `f2.txt`, false},
+		{`f[!12].txt`, `f3.txt`, true},
+		{`a[!x]b.txt`, `a/b.txt`, false},
+		{`a[!x-]b.txt`, `a.b.txt`, true},
+		{`report.(1).csv`, `report.(1).csv`, true},
+		{`report.csv`, `reportxcsv`, false},
+		{`\*.txt`, `*.txt`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+` `+tt.name, func(t *testing.T) {
+			got, err := MatchGlob(tt.pattern, tt.name)
+			if err != nil {
+				t.Error(err)
+			}
+			if got != tt.want {
+				t.Errorf(`MatchGlob() = %v, want %v`, got, tt.want)
+			}
+		})
+	}
+	if _, err := MatchGlob(`f[12.txt`, `f1.txt`); err == nil {
+		t.Error(`expected error for unterminated class`)
+	}
+	if p := globPrefix(`testing/1/*.txt`); p != `testing/1/` {
+		t.Errorf(`unexpected prefix %s`, p)
+	}
+}
+
+func Test_ListPage(t *testing.T) {
+	setup(t)
+	f := writeTestFiles(t)
+	defer deleteTestFiles(t, f)
+	ctx := context.Background()
+
+	// one object per page
+	opts := ListOptions{Prefix: testPath, PageSize: 1}
+	var names []string
+	for pages := 0; ; pages++ {
+		p, e := cs.ListPage(ctx, opts)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, oa := range p.Objects {
+			names = append(names, oa.Name)
+		}
+		if len(p.NextPageToken) == 0 {
+			if pages != 1 {
+				t.Errorf(`expected 2 pages, got %d`, pages+1)
+			}
+			break
+		}
+		opts.PageToken = p.NextPageToken
+	}
+	if len(names) != 2 {
+		t.Errorf(`expected 2 files, got %d`, len(names))
+	}
+
+	// hierarchical
+	dirs, files, e := cs.ListDir(ctx, testPath)
+	if e != nil {
+		t.Error(e)
+	}
+	if len(dirs) != 1 || len(files) != 0 {
+		t.Errorf(`expected 1 folder & 0 files, got %v & %d`, dirs, len(files))
+	}
+
+	// glob
+	m, e := cs.GetFilesMatching(testPath, `**/*.json`)
+	if e != nil {
+		t.Error(e)
+	}
+	if len(m) != 1 || m[0] != f[1] {
+		t.Errorf(`unexpected match %v`, m)
+	}
+	// the pattern applies to the name relative to path
+	dir := path.Dir(f[0]) + `/`
+	if m, e = cs.GetFilesMatching(dir, `*.txt`); e != nil || len(m) != 1 || m[0] != f[0] {
+		t.Errorf(`unexpected match %v %v`, m, e)
+	}
+	if m, e = cs.GetFilesMatching(testPath, `*.txt`); e != nil || len(m) != 0 {
+		t.Errorf(`* should not match within folders, got %v %v`, m, e)
+	}
+	if m, e = cs.GetFilesMatching(``, dir+`f?.json`); e != nil || len(m) != 1 || m[0] != f[1] {
+		t.Errorf(`unexpected match %v %v`, m, e)
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+/*
+	ObjectStore backed by a local directory tree
+	object names use '/' as the separator and map to paths relative to the root directory
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore - creates an ObjectStore rooted at dir, the directory is created if it does not exist
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if len(dir) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: abs}, nil
+}
+
+// Root - the directory holding the objects
+func (ls *LocalStore) Root() string {
+	return ls.root
+}
+
+// localPath - maps an object name to a file path, rejecting names that would escape the root directory
+func (ls *LocalStore) localPath(name string) (string, error) {
+	if len(name) == 0 || strings.HasSuffix(name, `/`) {
+		return ``, errors.New(`invalid object name: ` + name)
+	}
+	clean := path.Clean(`/` + name)
+	if clean != `/`+name {
+		return ``, errors.New(`invalid object name: ` + name)
+	}
+	return filepath.Join(ls.root, filepath.FromSlash(clean)), nil
+}
+
+// fileAttrs - builds object attributes for the file at p
+func (ls *LocalStore) fileAttrs(name, p string, fi os.FileInfo) (*storage.ObjectAttrs, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	c := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err = io.Copy(io.MultiWriter(h, c), f); err != nil {
+		return nil, err
+	}
+	return &storage.ObjectAttrs{
+		Name:        name,
+		ContentType: DefaultContentTypes.ByName(name),
+		Size:        fi.Size(),
+		MD5:         h.Sum(nil),
+		CRC32C:      c.Sum32(),
+		Generation:  fi.ModTime().UnixNano(),
+		Created:     fi.ModTime(),
+		Updated:     fi.ModTime(),
+	}, nil
+}
+
+// List - ObjectStore implementation
+func (ls *LocalStore) List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error) {
+	var result []storage.ObjectAttrs
+	err := filepath.Walk(ls.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		rel, err := filepath.Rel(ls.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if fi.IsDir() {
+			// skip directories that cannot contain a match
+			if p != ls.root && !strings.HasPrefix(name+`/`, prefix) && !strings.HasPrefix(prefix, name+`/`) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		a, err := ls.fileAttrs(name, p, fi)
+		if err != nil {
+			return err
+		}
+		result = append(result, *a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// Attrs - ObjectStore implementation
+func (ls *LocalStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p, err := ls.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return nil, notFound(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ls.fileAttrs(name, p, fi)
+}
+
+// NewReader - ObjectStore implementation
+func (ls *LocalStore) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	p, err := ls.localPath(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, 0, notFound(name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		if err == nil {
+			err = notFound(name)
+		}
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// Write - ObjectStore implementation. contentType is not retained, it is inferred from the file extension
+func (ls *LocalStore) Write(ctx context.Context, name string, content []byte, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, err := ls.localPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first, so readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(p), `.tmp-`)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Delete - ObjectStore implementation. directories left empty are removed
+func (ls *LocalStore) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, err := ls.localPath(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return notFound(name)
+	}
+	if err != nil {
+		return err
+	}
+	for d := filepath.Dir(p); d != ls.root; d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Copy - ObjectStore implementation
+func (ls *LocalStore) Copy(ctx context.Context, src string, dest ObjectStore, destName string) error {
+	return copyObject(ctx, ls, src, dest, destName)
+}
+
+// SignedURL - ObjectStore implementation. local files need no signing, so this is a file:// url to the object
+func (ls *LocalStore) SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return ``, err
+	}
+	p, err := ls.localPath(name)
+	if err != nil {
+		return ``, err
+	}
+	u := url.URL{Scheme: `file`, Path: filepath.ToSlash(p)}
+	return u.String(), nil
+}
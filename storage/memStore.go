@@ -0,0 +1,152 @@
+package storage
+
+/*
+	ObjectStore held entirely in memory, intended for unit tests
+*/
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memObject struct {
+	attrs   storage.ObjectAttrs
+	content []byte
+}
+
+type MemStore struct {
+	mu         sync.RWMutex
+	name       string
+	objects    map[string]*memObject
+	generation int64
+}
+
+// NewMemStore - creates an empty in memory ObjectStore, name is reported as the bucket in object attributes
+func NewMemStore(name string) *MemStore {
+	return &MemStore{name: name, objects: make(map[string]*memObject)}
+}
+
+// List - ObjectStore implementation
+func (ms *MemStore) List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var result []storage.ObjectAttrs
+	for n, o := range ms.objects {
+		if strings.HasPrefix(n, prefix) {
+			result = append(result, o.attrs)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// Attrs - ObjectStore implementation
+func (ms *MemStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	o, ok := ms.objects[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	a := o.attrs
+	return &a, nil
+}
+
+// NewReader - ObjectStore implementation
+func (ms *MemStore) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	o, ok := ms.objects[name]
+	if !ok {
+		return nil, 0, notFound(name)
+	}
+	// content is never modified in place, so the reader may share it
+	return ioutil.NopCloser(bytes.NewReader(o.content)), int64(len(o.content)), nil
+}
+
+// Write - ObjectStore implementation
+func (ms *MemStore) Write(ctx context.Context, name string, content []byte, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		return errors.New(`invalid object name`)
+	}
+	c := make([]byte, len(content))
+	copy(c, content)
+	sum := md5.Sum(c)
+	now := time.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.generation++
+	created := now
+	if o, ok := ms.objects[name]; ok {
+		created = o.attrs.Created
+	}
+	ms.objects[name] = &memObject{
+		content: c,
+		attrs: storage.ObjectAttrs{
+			Bucket:         ms.name,
+			Name:           name,
+			ContentType:    contentType,
+			Size:           int64(len(c)),
+			MD5:            sum[:],
+			CRC32C:         crc32.Checksum(c, crc32.MakeTable(crc32.Castagnoli)),
+			Generation:     ms.generation,
+			Metageneration: 1,
+			Created:        created,
+			Updated:        now,
+		},
+	}
+	return nil
+}
+
+// Delete - ObjectStore implementation
+func (ms *MemStore) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.objects[name]; !ok {
+		return notFound(name)
+	}
+	delete(ms.objects, name)
+	return nil
+}
+
+// Copy - ObjectStore implementation
+func (ms *MemStore) Copy(ctx context.Context, src string, dest ObjectStore, destName string) error {
+	return copyObject(ctx, ms, src, dest, destName)
+}
+
+// SignedURL - ObjectStore implementation. the url is not usable outside this package, but is unique per object and expiry
+func (ms *MemStore) SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return ``, err
+	}
+	u := url.URL{Scheme: `mem`, Host: ms.name, Path: `/` + name,
+		RawQuery: fmt.Sprintf(`method=%s&expires=%d`, url.QueryEscape(method), time.Now().Add(expires).Unix())}
+	return u.String(), nil
+}
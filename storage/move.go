@@ -0,0 +1,131 @@
+package storage
+
+/*
+	move, and prefix wide copy / rename, between CStores (which may be in different buckets)
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"strings"
+)
+
+// CopyOptions - controls CopyPrefix and RenamePrefix
+type CopyOptions struct {
+	// Transfer - concurrency and retry settings, a retried copy resumes from its last rewrite token
+	Transfer TransferOptions
+	// DestConds - preconditions applied to every destination object, e.g. DoesNotExist to avoid overwriting
+	DestConds storage.Conditions
+	// Progress - optional, called as large objects are rewritten. Must be safe for concurrent use
+	Progress func(object string, copiedBytes, totalBytes uint64)
+}
+
+// copier - a resumable copy of src to dest; large objects are copied in several rewrite calls, and if Run fails part
+// way the copier retains the rewrite token, so running it again continues rather than restarting
+func (cs *CStore) copier(src *storage.ObjectHandle, dest *storage.ObjectHandle, progress func(string, uint64, uint64)) *storage.Copier {
+	c := dest.CopierFrom(src)
+	if progress != nil {
+		name := src.ObjectName()
+		c.ProgressFunc = func(copied, total uint64) { progress(name, copied, total) }
+	}
+	return c
+}
+
+// runCopier - a single attempt at completing the copy, bounded by the default timeout
+func (cs *CStore) runCopier(ctx context.Context, c *storage.Copier, dest string) (*storage.ObjectAttrs, error) {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	a, err := c.Run(ctx)
+	return a, classify(dest, err)
+}
+
+// Move - copy src to dest then delete src. The copy is pinned to the generation of src found at the start, and src is
+// only deleted if that is still its generation, so an update made to src during the move is never lost
+// (a PreconditionError is returned, and both objects remain). destConds may be empty
+func (cs *CStore) Move(ctx context.Context, src string, destcs *CStore, dest string, destConds storage.Conditions) (*storage.ObjectAttrs, error) {
+	sa, err := cs.Attrs(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	return cs.moveGeneration(ctx, src, sa.Generation, destcs, dest, destConds)
+}
+
+// moveGeneration - moves generation gen of src to dest
+func (cs *CStore) moveGeneration(ctx context.Context, src string, gen int64, destcs *CStore, dest string,
+	destConds storage.Conditions) (*storage.ObjectAttrs, error) {
+	pin := storage.Conditions{GenerationMatch: gen}
+	c := cs.copier(cs.object(ctx, src).If(pin), withConditions(destcs.object(ctx, dest), &destConds), nil)
+	a, err := cs.runCopier(ctx, c, dest)
+	if err != nil {
+		return nil, err
+	}
+	return a, cs.deleteMoved(ctx, src, gen)
+}
+
+// deleteMoved - deletes generation gen of a moved object. The object already being gone is not an error, as a retried
+// delete finds it so when an earlier attempt succeeded but its response was lost
+func (cs *CStore) deleteMoved(ctx context.Context, name string, gen int64) error {
+	if err := cs.DeleteIf(ctx, name, storage.Conditions{GenerationMatch: gen}); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// CopyPrefix - copies every object below srcPrefix to destcs, replacing srcPrefix with destPrefix in each name.
+// Objects are copied concurrently, failures are reported per object in the returned report
+func (cs *CStore) CopyPrefix(ctx context.Context, srcPrefix string, destcs *CStore, destPrefix string, opts CopyOptions) (*TransferReport, error) {
+	return cs.prefixTransfer(ctx, srcPrefix, destcs, destPrefix, opts, false)
+}
+
+// RenamePrefix - moves every object below srcPrefix to destcs (see Move), replacing srcPrefix with destPrefix in each name.
+// Objects are moved concurrently, failures are reported per object in the returned report
+func (cs *CStore) RenamePrefix(ctx context.Context, srcPrefix string, destcs *CStore, destPrefix string, opts CopyOptions) (*TransferReport, error) {
+	return cs.prefixTransfer(ctx, srcPrefix, destcs, destPrefix, opts, true)
+}
+
+// prefixJob - state of a single object's copy or move, kept across retries
+type prefixJob struct {
+	copier *storage.Copier
+	gen    int64
+	copied bool
+}
+
+func (cs *CStore) prefixTransfer(ctx context.Context, srcPrefix string, destcs *CStore, destPrefix string, opts CopyOptions, move bool) (*TransferReport, error) {
+	if destcs == nil {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	l, err := cs.GetFileInfoCtx(ctx, srcPrefix)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]TransferResult, len(l))
+	jobs := make(map[*TransferResult]*prefixJob, len(l))
+	for i, oa := range l {
+		dest := destPrefix + strings.TrimPrefix(oa.Name, srcPrefix)
+		results[i] = TransferResult{Object: oa.Name, Dest: dest}
+		if dest == oa.Name && destcs.BucketName() == cs.BucketName() {
+			results[i].Err = errors.New(`source and destination are the same object: ` + dest)
+			continue
+		}
+		// pinned to the listed generation, so a concurrent update is reported rather than silently copied / lost
+		s := cs.object(ctx, oa.Name).If(storage.Conditions{GenerationMatch: oa.Generation})
+		d := withConditions(destcs.object(ctx, dest), &opts.DestConds)
+		jobs[&results[i]] = &prefixJob{copier: cs.copier(s, d, opts.Progress), gen: oa.Generation}
+	}
+	rep := runTransfers(ctx, results, opts.Transfer, func(ctx context.Context, r *TransferResult) error {
+		j := jobs[r]
+		if !j.copied {
+			a, err := cs.runCopier(ctx, j.copier, r.Dest)
+			if err != nil {
+				return err
+			}
+			j.copied = true
+			r.Bytes = a.Size
+		}
+		if move {
+			return cs.deleteMoved(ctx, r.Object, j.gen)
+		}
+		return nil
+	})
+	return rep, nil
+}
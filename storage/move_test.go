@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/storagetest"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_Move(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	f := writeTestFiles(t)
+	dest := testPath + `moved/f1.txt`
+	if _, e := cs.Move(ctx, f[0], cs, dest, storage.Conditions{DoesNotExist: true}); e != nil {
+		t.Fatal(e)
+	}
+	if cs.FileExists(f[0]) || !cs.FileExists(dest) {
+		t.Error(`file was not moved`)
+	}
+	// the destination now exists, so a second move must fail and leave the source alone
+	if _, e := cs.Move(ctx, f[1], cs, dest, storage.Conditions{DoesNotExist: true}); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition, got`, e)
+	}
+	if !cs.FileExists(f[1]) {
+		t.Error(`source should remain after a failed move`)
+	}
+	deleteTestFiles(t, []string{f[1], dest})
+}
+
+func Test_CopyRenamePrefix(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	f := writeTestFiles(t)
+	src := f[0][:len(f[0])-len(`f1.txt`)]
+
+	rep, e := cs.CopyPrefix(ctx, src, cs, testPath+`copied/`, CopyOptions{Transfer: TransferOptions{Workers: 2}})
+	if e != nil || rep.Err() != nil {
+		t.Fatal(e, rep.Err())
+	}
+	copied, _ := cs.GetFiles(testPath + `copied/`)
+	if len(copied) != 2 {
+		t.Errorf(`expected 2 copies, got %v`, copied)
+	}
+
+	// copying again with DoesNotExist reports each object as failed, without aborting
+	rep, _ = cs.CopyPrefix(ctx, src, cs, testPath+`copied/`, CopyOptions{DestConds: storage.Conditions{DoesNotExist: true}})
+	if rep.Failed != 2 || !errors.Is(rep.Results[0].Err, ErrPrecondition) {
+		t.Errorf(`expected 2 precondition failures, got %d`, rep.Failed)
+	}
+
+	rep, e = cs.RenamePrefix(ctx, testPath+`copied/`, cs, testPath+`renamed/`, CopyOptions{})
+	if e != nil || rep.Err() != nil {
+		t.Fatal(e, rep.Err())
+	}
+	renamed, _ := cs.GetFiles(testPath + `renamed/`)
+	if left, _ := cs.GetFiles(testPath + `copied/`); len(left) != 0 || len(renamed) != 2 {
+		t.Errorf(`unexpected rename result %v %v`, left, renamed)
+	}
+	deleteTestFiles(t, append(f, renamed...))
+}
+
+func Test_MoveLostResponse(t *testing.T) {
+	srv := storagetest.NewServer(`moves`)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	lt := &lostResponseTransport{lost: 1, base: emulatorTransport{host: u.Host, base: http.DefaultTransport},
+		match: func(r *http.Request) bool { return r.Method == http.MethodDelete }}
+	ctx := context.Background()
+	st, e := NewCStoreWith(ctx, `moves`, WithEmulator(srv.URL), WithHTTPClient(&http.Client{Transport: lt}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer st.Close()
+	for _, n := range []string{`a.txt`, `src/b.txt`, `src/c.txt`} {
+		if e = st.WriteFile(n, fileContents); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// the source is deleted but the response lost, the retried delete finds it gone
+	atomic.StoreInt32(&lt.lost, 0)
+	if _, e = st.Move(ctx, `a.txt`, st, `moved.txt`, storage.Conditions{}); e != nil {
+		t.Error(`expected the move to succeed, got`, e)
+	}
+	atomic.StoreInt32(&lt.lost, 0)
+	rep, e := st.RenamePrefix(ctx, `src/`, st, `dest/`, CopyOptions{})
+	if e != nil || rep.Err() != nil {
+		t.Error(`expected the rename to succeed, got`, e, rep.Err())
+	}
+	if l := srv.Objects(`moves`); strings.Join(l, `,`) != `dest/b.txt,dest/c.txt,moved.txt` {
+		t.Error(`unexpected objects`, l)
+	}
+}
@@ -0,0 +1,144 @@
+package storage
+
+/*
+	backend agnostic object store
+	CStore (GCP cloud storage), LocalStore (directory tree) and MemStore (in memory) all satisfy ObjectStore,
+	so code written against the interface can be unit tested without access to a bucket
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ObjectStore - operations common to all storage backends.
+// Object attributes are reported using storage.ObjectAttrs regardless of backend, only the fields a backend
+// can supply are populated. A missing object is reported as an error matching (via errors.Is) ErrNotFound and storage.ErrObjectNotExist
+type ObjectStore interface {
+	// List - attributes of all objects whose name begins with prefix, in name order
+	List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error)
+	// Attrs - attributes of a single object
+	Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error)
+	// NewReader - remember to close the Reader after use. second parameter is the object size in bytes
+	NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error)
+	// Write - create or replace an object
+	Write(ctx context.Context, name string, content []byte, contentType string) error
+	// Delete - remove an object
+	Delete(ctx context.Context, name string) error
+	// Copy - copy an object to destName within dest, which may be a different store or backend
+	Copy(ctx context.Context, src string, dest ObjectStore, destName string) error
+	// SignedURL - a time limited url granting method access to the object
+	SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error)
+}
+
+var _ ObjectStore = (*CStore)(nil)
+var _ ObjectStore = (*LocalStore)(nil)
+var _ ObjectStore = (*MemStore)(nil)
+
+// ReadObject - convenience routine to read the entire content of an object
+func ReadObject(ctx context.Context, st ObjectStore, name string) ([]byte, error) {
+	r, _, err := st.NewReader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// ObjectExists - returns true if the object can be found, any error other than ErrNotFound is returned
+func ObjectExists(ctx context.Context, st ObjectStore, name string) (bool, error) {
+	_, err := st.Attrs(ctx, name)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// copyObject - copy between stores that have no native means of copying, by reading and rewriting the content
+func copyObject(ctx context.Context, src ObjectStore, srcName string, dest ObjectStore, destName string) error {
+	a, err := src.Attrs(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	b, err := ReadObject(ctx, src, srcName)
+	if err != nil {
+		return err
+	}
+	return dest.Write(ctx, destName, b, a.ContentType)
+}
+
+// writeStream - writes the content produced by fn to name, streaming it to stores that support it
+// (such as CStore), otherwise collecting it in memory first
+func writeStream(ctx context.Context, st ObjectStore, name string, opts *WriteOptions, fn func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(fn(pw))
+	}()
+	var err error
+	if sw, ok := st.(streamWriter); ok {
+		_, err = sw.WriteFrom(ctx, name, pr, opts)
+	} else {
+		var b []byte
+		if b, err = ioutil.ReadAll(pr); err == nil {
+			err = st.Write(ctx, name, b, opts.contentType())
+		}
+	}
+	// unblock fn if the store stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return err
+}
+
+// List - ObjectStore implementation, see GetFileInfoCtx
+func (cs *CStore) List(ctx context.Context, prefix string) ([]storage.ObjectAttrs, error) {
+	return cs.GetFileInfoCtx(ctx, prefix)
+}
+
+// Attrs - ObjectStore implementation
+func (cs *CStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	var a *storage.ObjectAttrs
+	oh := cs.object(ctx, name)
+	err := cs.retry(ctx, name, func(ctx context.Context) error {
+		var err error
+		a, err = oh.Attrs(ctx)
+		return err
+	})
+	return a, err
+}
+
+// NewReader - ObjectStore implementation, see GetFileReaderCtx
+func (cs *CStore) NewReader(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	r, size, err := cs.GetFileReaderCtx(ctx, name)
+	if err != nil {
+		return nil, size, err
+	}
+	return r, size, nil
+}
+
+// Write - ObjectStore implementation, see WriteCloudFileCtx
+func (cs *CStore) Write(ctx context.Context, name string, content []byte, contentType string) error {
+	return cs.WriteCloudFileCtx(ctx, name, content, contentType)
+}
+
+// Delete - ObjectStore implementation, see DeleteCloudFileCtx
+func (cs *CStore) Delete(ctx context.Context, name string) error {
+	return cs.DeleteCloudFileCtx(ctx, name)
+}
+
+// Copy - ObjectStore implementation. copies between CStores are performed within the cloud
+func (cs *CStore) Copy(ctx context.Context, src string, dest ObjectStore, destName string) error {
+	if d, ok := dest.(*CStore); ok {
+		return cs.CopyFileCtx(ctx, src, d, destName)
+	}
+	return copyObject(ctx, cs, src, dest, destName)
+}
+
+// SignedURL - ObjectStore implementation, see SignURL
+func (cs *CStore) SignedURL(ctx context.Context, name string, method string, expires time.Duration) (string, error) {
+	return cs.SignURL(ctx, name, URLOptions{Method: method, Expires: expires})
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// objectStores - the backends the ObjectStore suite is run against.
+// the GCP store is the fake server when a utilities_config is not available
+func objectStores(t *testing.T) map[string]ObjectStore {
+	ls, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]ObjectStore{`memory`: NewMemStore(`test`), `local`: ls}
+	setup(t)
+	result[`gcp`] = cs
+	return result
+}
+
+// forEachStore - runs fn as a subtest against each backend
+func forEachStore(t *testing.T, fn func(t *testing.T, st ObjectStore)) {
+	for name, st := range objectStores(t) {
+		st := st
+		t.Run(name, func(t *testing.T) {
+			fn(t, st)
+		})
+	}
+}
+
+// writeStoreFiles - as writeTestFiles, for any backend
+func writeStoreFiles(t *testing.T, st ObjectStore) []string {
+	if c, ok := st.(*CStore); ok && c == cs {
+		return writeTestFiles(t)
+	}
+	tfc++
+	path := testPath + strconv.Itoa(tfc) + `/`
+	result := []string{path + `f1.txt`, path + `f2.json`}
+	for i, ct := range []string{`text/plain`, `application/json`} {
+		if e := st.Write(context.Background(), result[i], []byte(fileContents), ct); e != nil {
+			t.Fatal(`unable to write to `+result[i], e)
+		}
+	}
+	return result
+}
+
+// deleteStoreFiles - as deleteTestFiles, for any backend
+func deleteStoreFiles(t *testing.T, st ObjectStore, fnames []string) {
+	for _, cfile := range fnames {
+		if err := st.Delete(context.Background(), cfile); err != nil {
+			t.Error("Failed to delete "+cfile, err)
+		}
+	}
+}
+
+func Test_ObjectStore(t *testing.T) {
+	forEachStore(t, testObjectStore)
+}
+
+func testObjectStore(t *testing.T, st ObjectStore) {
+	ctx := context.Background()
+	path := testPath + `os/` + strconv.FormatInt(time.Now().UnixNano(), 36) + `/`
+	f1, f2 := path+`f1.txt`, path+`sub/f2.json`
+	if e := st.Write(ctx, f1, []byte(fileContents), `text/plain`); e != nil {
+		t.Fatal(e)
+	}
+	if e := st.Write(ctx, f2, []byte(fileContents), `application/json`); e != nil {
+		t.Fatal(e)
+	}
+
+	// existence
+	if ok, e := ObjectExists(ctx, st, f1); !ok || e != nil {
+		t.Error(`expected object to exist`, e)
+	}
+	if ok, e := ObjectExists(ctx, st, path+`missing.txt`); ok || e != nil {
+		t.Error(`did not expect object to exist`, e)
+	}
+	if _, _, e := st.NewReader(ctx, path+`missing.txt`); !errors.Is(e, ErrNotFound) || !errors.Is(e, storage.ErrObjectNotExist) {
+		t.Error(`expected ErrNotFound, got`, e)
+	}
+
+	// listing
+	l, e := st.List(ctx, path)
+	if e != nil {
+		t.Error(e)
+	}
+	if len(l) != 2 || l[0].Name != f1 || l[1].Name != f2 {
+		t.Errorf(`unexpected listing %v`, l)
+	} else {
+		if l[1].Size != 37 {
+			t.Errorf(`Unexpected filesize - %d`, l[1].Size)
+		}
+		if !strings.HasPrefix(l[1].ContentType, `application/json`) {
+			t.Errorf(`Unexpected content type - %s`, l[1].ContentType)
+		}
+	}
+	if l, _ = st.List(ctx, path+`sub/`); len(l) != 1 {
+		t.Errorf(`expected 1 object below sub/, got %d`, len(l))
+	}
+
+	// reading
+	b, e := ReadObject(ctx, st, f1)
+	if e != nil {
+		t.Error(e)
+	}
+	if string(b) != fileContents {
+		t.Errorf(`Expected "%s" got "%s"`, fileContents, b)
+	}
+
+	// copy within the store and to another backend
+	f3 := path + `cpy.txt`
+	if e = st.Copy(ctx, f1, st, f3); e != nil {
+		t.Error(`copy failed`, e)
+	}
+	other := NewMemStore(`other`)
+	if e = st.Copy(ctx, f1, other, `x.txt`); e != nil {
+		t.Error(`copy to other store failed`, e)
+	}
+	if b, _ = ReadObject(ctx, other, `x.txt`); string(b) != fileContents {
+		t.Error(`unexpected content in copied object`)
+	}
+
+	if _, e = st.SignedURL(ctx, f1, `GET`, time.Minute); e != nil {
+		t.Error(e)
+	}
+
+	// cleanup
+	for _, fn := range []string{f1, f2, f3} {
+		if e = st.Delete(ctx, fn); e != nil {
+			t.Error(`Failed to delete `+fn, e)
+		}
+	}
+	if l, _ = st.List(ctx, path); len(l) != 0 {
+		t.Errorf(`expected no objects after delete, got %d`, len(l))
+	}
+	if e = st.Delete(ctx, f1); !errors.Is(e, ErrNotFound) || !errors.Is(e, storage.ErrObjectNotExist) {
+		t.Error(`expected ErrNotFound, got`, e)
+	}
+}
+
+func Test_LocalStorePaths(t *testing.T) {
+	ls, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{`../escape.txt`, `a/../../escape.txt`, `a//b.txt`, `/abs.txt`, `dir/`, ``} {
+		if e := ls.Write(context.Background(), n, []byte(`x`), ``); e == nil {
+			t.Errorf(`expected write of "%s" to be rejected`, n)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package storage
+
+/*
+	rule based retention for ObjectStore contents, and access to a bucket's native lifecycle configuration
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AgeBasis - which object timestamp the age of an object is measured from
+type AgeBasis int
+
+const (
+	ByCreated AgeBasis = iota
+	ByUpdated
+)
+
+// RetentionRule - selects objects and decides which of them to delete.
+// Within each group the newest KeepLast objects are always kept, the remainder are deleted if older than MaxAge,
+// or once the group's cumulative size (newest first) exceeds MaxBytes. When only KeepLast is set, everything beyond
+// the newest KeepLast is deleted
+type RetentionRule struct {
+	// Prefix, Suffix and Pattern select the objects the rule applies to. Pattern is a glob matched, as for
+	// ListOptions, against the object name relative to Prefix, e.g. Prefix "logs/" with Pattern "*.gz"
+	Prefix  string
+	Suffix  string
+	Pattern string
+	// MaxAge - delete objects older than this, zero for no age limit
+	MaxAge   time.Duration
+	AgeBasis AgeBasis
+	// KeepLast - number of newest objects kept regardless of age or size
+	KeepLast int
+	// MaxBytes - total size allowed for the group, zero for no limit
+	MaxBytes int64
+	// PerFolder - apply KeepLast / MaxBytes to each folder (name up to the last '/') separately,
+	// rather than to everything the rule selects
+	PerFolder bool
+}
+
+// RetentionOptions - controls ApplyRetention
+type RetentionOptions struct {
+	// DryRun - report the objects that would be deleted, without deleting them
+	DryRun bool
+	// Transfer - concurrency and retry settings for the deletes
+	Transfer TransferOptions
+	// Now - the time ages are measured against, defaults to the current time
+	Now time.Time
+}
+
+// RetentionDeletion - an object deleted (or to be deleted) by a rule
+type RetentionDeletion struct {
+	Name   string
+	Size   int64
+	Rule   int
+	Reason string
+	Err    error
+}
+
+// RetentionReport - outcome of ApplyRetention, Deleted is in name order
+type RetentionReport struct {
+	Deleted []RetentionDeletion
+	Kept    int
+	Bytes   int64
+	Failed  int
+	DryRun  bool
+}
+
+// Err - nil if every deletion succeeded
+func (rr *RetentionReport) Err() error {
+	for _, d := range rr.Deleted {
+		if d.Err != nil {
+			return errors.New(`delete ` + d.Name + ` failed: ` + d.Err.Error())
+		}
+	}
+	return nil
+}
+
+// timestamp - the time the rule measures age from
+func (r *RetentionRule) timestamp(oa *storage.ObjectAttrs) time.Time {
+	if r.AgeBasis == ByUpdated && !oa.Updated.IsZero() {
+		return oa.Updated
+	}
+	return oa.Created
+}
+
+// evaluate - returns the objects the rule deletes, with the reason, from the listing l (already filtered by Prefix)
+func (r *RetentionRule) evaluate(l []storage.ObjectAttrs, now time.Time) (map[string]string, error) {
+	var re *regexp.Regexp
+	if len(r.Pattern) > 0 {
+		var err error
+		if re, err = globRegexp(r.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	groups := make(map[string][]storage.ObjectAttrs)
+	for _, oa := range l {
+		if !strings.HasSuffix(oa.Name, r.Suffix) || (re != nil && !re.MatchString(strings.TrimPrefix(oa.Name, r.Prefix))) {
+			continue
+		}
+		g := ``
+		if r.PerFolder {
+			g = path.Dir(oa.Name)
+		}
+		groups[g] = append(groups[g], oa)
+	}
+	result := make(map[string]string)
+	for _, g := range groups {
+		sort.Slice(g, func(i, j int) bool { return r.timestamp(&g[i]).After(r.timestamp(&g[j])) })
+		var total int64
+		for i := range g {
+			oa := &g[i]
+			reason := ``
+			switch {
+			case i < r.KeepLast:
+			case r.MaxAge > 0 && now.Sub(r.timestamp(oa)) > r.MaxAge:
+				reason = `age`
+			case r.MaxBytes > 0 && total+oa.Size > r.MaxBytes:
+				reason = `size`
+			case r.MaxAge == 0 && r.MaxBytes == 0 && r.KeepLast > 0:
+				reason = `keep-last`
+			}
+			if len(reason) == 0 {
+				total += oa.Size
+			} else {
+				result[oa.Name] = reason
+			}
+		}
+	}
+	return result, nil
+}
+
+// ApplyRetention - evaluates each rule against the store, deleting every object any rule selects for deletion
+func ApplyRetention(ctx context.Context, st ObjectStore, rules []RetentionRule, opts RetentionOptions) (*RetentionReport, error) {
+	if len(rules) == 0 {
+		return nil, errors.New(`no retention rules`)
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	// list once, using the longest prefix common to all rules
+	common := rules[0].Prefix
+	for _, r := range rules[1:] {
+		for !strings.HasPrefix(r.Prefix, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	l, err := st.List(ctx, common)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{DryRun: opts.DryRun}
+	found := make(map[string]bool)
+	for ri := range rules {
+		var selected []storage.ObjectAttrs
+		for _, oa := range l {
+			if strings.HasPrefix(oa.Name, rules[ri].Prefix) {
+				selected = append(selected, oa)
+			}
+		}
+		del, e := rules[ri].evaluate(selected, now)
+		if e != nil {
+			return nil, e
+		}
+		for _, oa := range selected {
+			if reason, ok := del[oa.Name]; ok {
+				if !found[oa.Name] {
+					found[oa.Name] = true
+					report.Deleted = append(report.Deleted, RetentionDeletion{Name: oa.Name, Size: oa.Size, Rule: ri, Reason: reason})
+				}
+			}
+		}
+	}
+	report.Kept = len(l) - len(report.Deleted)
+	sort.Slice(report.Deleted, func(i, j int) bool { return report.Deleted[i].Name < report.Deleted[j].Name })
+	for _, d := range report.Deleted {
+		report.Bytes += d.Size
+	}
+	if opts.DryRun || len(report.Deleted) == 0 {
+		return report, nil
+	}
+
+	results := make([]TransferResult, len(report.Deleted))
+	for i, d := range report.Deleted {
+		results[i].Object = d.Name
+	}
+	runTransfers(ctx, results, opts.Transfer, func(ctx context.Context, r *TransferResult) error {
+		err := st.Delete(ctx, r.Object)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			// already gone, which is the desired outcome
+			return nil
+		}
+		return err
+	})
+	for i := range results {
+		if report.Deleted[i].Err = results[i].Err; results[i].Err != nil {
+			report.Failed++
+			report.Bytes -= report.Deleted[i].Size
+		}
+	}
+	return report, nil
+}
+
+// ApplyRetention - see the package level ApplyRetention
+func (cs *CStore) ApplyRetention(ctx context.Context, rules []RetentionRule, opts RetentionOptions) (*RetentionReport, error) {
+	return ApplyRetention(ctx, cs, rules, opts)
+}
+
+// LifecycleRules - converts retention rules to native bucket lifecycle rules. Only whole bucket, created age rules
+// can be expressed natively, any other rule results in an error
+func LifecycleRules(rules []RetentionRule) ([]storage.LifecycleRule, error) {
+	var result []storage.LifecycleRule
+	for _, r := range rules {
+		if len(r.Prefix) > 0 || len(r.Suffix) > 0 || len(r.Pattern) > 0 || r.KeepLast > 0 || r.MaxBytes > 0 ||
+			r.AgeBasis != ByCreated || r.MaxAge <= 0 {
+			return nil, errors.New(`retention rule cannot be expressed as a bucket lifecycle rule`)
+		}
+		days := int64((r.MaxAge + 24*time.Hour - 1) / (24 * time.Hour))
+		result = append(result, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: days},
+		})
+	}
+	return result, nil
+}
+
+// GetLifecycle - returns the bucket's native lifecycle configuration
+func (cs *CStore) GetLifecycle(ctx context.Context) (*storage.Lifecycle, error) {
+	a, err := cs.BucketAttrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &a.Lifecycle, nil
+}
+
+// SetLifecycle - replaces the bucket's native lifecycle configuration, an empty Lifecycle removes all rules
+func (cs *CStore) SetLifecycle(ctx context.Context, lc storage.Lifecycle) error {
+	_, err := cs.UpdateBucket(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lc})
+	return err
+}
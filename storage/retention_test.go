@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetentionRule(t *testing.T) {
+	now := time.Now()
+	obj := func(name string, ageh int, size int64) storage.ObjectAttrs {
+		ts := now.Add(-time.Duration(ageh) * time.Hour)
+		return storage.ObjectAttrs{Name: name, Created: ts, Updated: ts, Size: size}
+	}
+	l := []storage.ObjectAttrs{
+		obj(`logs/a/1.log`, 1, 10), obj(`logs/a/2.log`, 2, 10), obj(`logs/a/3.log`, 30, 10),
+		obj(`logs/b/1.log`, 50, 10), obj(`logs/b/1.txt`, 51, 10),
+	}
+	tests := []struct {
+		name string
+		rule RetentionRule
+		want map[string]string
+	}{
+		{`age`, RetentionRule{MaxAge: 24 * time.Hour},
+			map[string]string{`logs/a/3.log`: `age`, `logs/b/1.log`: `age`, `logs/b/1.txt`: `age`}},
+		{`suffix`, RetentionRule{MaxAge: 24 * time.Hour, Suffix: `.txt`}, map[string]string{`logs/b/1.txt`: `age`}},
+		{`glob`, RetentionRule{MaxAge: 24 * time.Hour, Prefix: `logs/a/`, Pattern: `*.log`}, map[string]string{`logs/a/3.log`: `age`}},
+		{`glob in folders`, RetentionRule{MaxAge: 24 * time.Hour, Prefix: `logs/`, Pattern: `*/*.log`},
+			map[string]string{`logs/a/3.log`: `age`, `logs/b/1.log`: `age`}},
+		{`glob below prefix`, RetentionRule{MaxAge: 24 * time.Hour, Prefix: `logs/`, Pattern: `*.log`}, map[string]string{}},
+		{`keep`, RetentionRule{KeepLast: 2, Suffix: `.log`},
+			map[string]string{`logs/a/3.log`: `keep-last`, `logs/b/1.log`: `keep-last`}},
+		{`keep per folder`, RetentionRule{KeepLast: 1, Suffix: `.log`, PerFolder: true},
+			map[string]string{`logs/a/2.log`: `keep-last`, `logs/a/3.log`: `keep-last`}},
+		{`keep protects old`, RetentionRule{KeepLast: 1, MaxAge: time.Minute, PerFolder: true},
+			map[string]string{`logs/a/2.log`: `age`, `logs/a/3.log`: `age`, `logs/b/1.txt`: `age`}},
+		{`size`, RetentionRule{MaxBytes: 25}, map[string]string{`logs/a/3.log`: `size`, `logs/b/1.log`: `size`, `logs/b/1.txt`: `size`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule.evaluate(append([]storage.ObjectAttrs(nil), l...), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf(`got %v, want %v`, got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf(`%s: got %s, want %s`, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`test`)
+	for _, n := range []string{`r/a.txt`, `r/b.txt`, `r/c.csv`, `other/d.txt`} {
+		_ = ms.Write(ctx, n, []byte(n), `text/plain`)
+	}
+	rules := []RetentionRule{{Prefix: `r/`, Suffix: `.txt`, MaxAge: time.Hour}, {Prefix: `r/`, Pattern: `*.csv`, MaxAge: time.Hour}}
+	opts := RetentionOptions{DryRun: true, Now: time.Now().Add(2 * time.Hour)}
+	rep, err := ApplyRetention(ctx, ms, rules, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Deleted) != 3 || rep.Kept != 0 || rep.Deleted[2].Rule != 1 {
+		t.Errorf(`unexpected report %+v`, rep)
+	}
+	if l, _ := ms.List(ctx, ``); len(l) != 4 {
+		t.Error(`dry run should not delete`)
+	}
+	opts.DryRun = false
+	if rep, err = ApplyRetention(ctx, ms, rules, opts); err != nil || rep.Err() != nil {
+		t.Fatal(err, rep.Err())
+	}
+	if l, _ := ms.List(ctx, ``); len(l) != 1 || l[0].Name != `other/d.txt` {
+		t.Errorf(`unexpected objects remaining %v`, l)
+	}
+	if rep.Bytes != 21 {
+		t.Errorf(`unexpected bytes %d`, rep.Bytes)
+	}
+}
+
+func TestLifecycleRules(t *testing.T) {
+	lr, err := LifecycleRules([]RetentionRule{{MaxAge: 36 * time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lr) != 1 || lr[0].Condition.AgeInDays != 2 || lr[0].Action.Type != storage.DeleteAction {
+		t.Errorf(`unexpected lifecycle %+v`, lr)
+	}
+	if _, err = LifecycleRules([]RetentionRule{{MaxAge: time.Hour, KeepLast: 2}}); err == nil {
+		t.Error(`expected error for keep-last rule`)
+	}
+}
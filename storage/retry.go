@@ -0,0 +1,92 @@
+package storage
+
+/*
+	retries of idempotent CStore operations
+	reads, listings, attribute lookups, cloud copies and conditional writes are retried on rate limiting, server
+	errors and network failures, with exponential backoff. Other operations are attempted once
+*/
+import (
+	"context"
+	"errors"
+	"google.golang.org/api/googleapi"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy - how failed idempotent operations are retried
+type RetryPolicy struct {
+	MaxAttempts  int           // including the first, values below 2 disable retries
+	InitialDelay time.Duration // delay before the first retry
+	MaxDelay     time.Duration // upper limit of the delay between attempts, zero for no limit
+	Multiplier   float64       // growth of the delay after each retry, values below 1 are treated as 1
+	Retryable    func(error) bool
+}
+
+// DefaultRetryPolicy - the policy of a newly created CStore
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, InitialDelay: 500 * time.Millisecond, MaxDelay: 16 * time.Second,
+	Multiplier: 2, Retryable: IsRetryable}
+
+// NoRetry - a policy making a single attempt at each operation
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// SetRetryPolicy - sets the policy applied to idempotent operations of this store
+func (cs *CStore) SetRetryPolicy(p RetryPolicy) {
+	cs.retryPolicy = p
+}
+
+// RetryPolicy - returns the policy applied to idempotent operations
+func (cs *CStore) RetryPolicy() RetryPolicy {
+	return cs.retryPolicy
+}
+
+// IsRetryable - true for rate limiting, server errors and network failures
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		return ge.Code == http.StatusRequestTimeout || ge.Code >= http.StatusInternalServerError
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// delay - the backoff before retry n (from 1), with jitter of up to half the delay
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < n; i++ {
+		if p.Multiplier > 1 {
+			d *= p.Multiplier
+		}
+		if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+			d = float64(p.MaxDelay)
+			break
+		}
+	}
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+// retry - calls op until it succeeds, returns an error that is not retryable, or the attempts are exhausted.
+// each attempt is bounded by the default timeout, errors are classified against object
+func (cs *CStore) retry(ctx context.Context, object string, op func(ctx context.Context) error) error {
+	p := cs.retryPolicy
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	for n := 1; ; n++ {
+		actx, cancel := cs.opContext(ctx)
+		err := classify(object, op(actx))
+		cancel()
+		if err == nil || n >= p.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if !sleepCtx(ctx, p.delay(n)) {
+			return err
+		}
+	}
+}
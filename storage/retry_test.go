@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/api/googleapi"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	st := &CStore{retryPolicy: RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, Multiplier: 2}}
+	calls := 0
+	failing := func(err error) func(context.Context) error {
+		calls = 0
+		return func(context.Context) error {
+			calls++
+			return err
+		}
+	}
+
+	if e := st.retry(ctx, `a`, failing(&googleapi.Error{Code: 503})); e == nil || calls != 3 {
+		t.Errorf(`expected 3 attempts, got %d %v`, calls, e)
+	}
+	if e := st.retry(ctx, `a`, failing(&googleapi.Error{Code: 429})); !errors.Is(e, ErrRateLimited) || calls != 3 {
+		t.Errorf(`expected 3 attempts, got %d %v`, calls, e)
+	}
+	if e := st.retry(ctx, `a`, failing(&googleapi.Error{Code: 404})); !errors.Is(e, ErrNotFound) || calls != 1 {
+		t.Errorf(`expected a single attempt, got %d %v`, calls, e)
+	}
+
+	// succeeds on the second attempt
+	calls = 0
+	e := st.retry(ctx, `a`, func(context.Context) error {
+		if calls++; calls < 2 {
+			return &googleapi.Error{Code: 500}
+		}
+		return nil
+	})
+	if e != nil || calls != 2 {
+		t.Errorf(`expected success after 2 attempts, got %d %v`, calls, e)
+	}
+
+	st.SetRetryPolicy(NoRetry)
+	if e = st.retry(ctx, `a`, failing(&googleapi.Error{Code: 503})); e == nil || calls != 1 {
+		t.Errorf(`expected a single attempt, got %d %v`, calls, e)
+	}
+
+	// cancellation stops retries
+	st.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialDelay: time.Hour})
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if e = st.retry(cctx, `a`, failing(&googleapi.Error{Code: 503})); e == nil || calls != 1 {
+		t.Errorf(`expected a single attempt, got %d %v`, calls, e)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+	for n, max := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		if d := p.delay(n); d < max/2 || d > max {
+			t.Errorf(`retry %d: delay %v outside %v - %v`, n, d, max/2, max)
+		}
+	}
+}
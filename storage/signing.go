@@ -0,0 +1,297 @@
+package storage
+
+/*
+	signed URLs and POST policy documents for CStore objects
+	signing is delegated to a Signer, either a service account private key or the IAM Credentials signBlob API,
+	so stores created without credentials (NewCStoreP) can also sign
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Signer - produces RSA-SHA256 signatures on behalf of a service account
+type Signer interface {
+	// Email - the service account the signatures are made for
+	Email() string
+	// SignBytes - returns the RSA-SHA256 signature of b
+	SignBytes(ctx context.Context, b []byte) ([]byte, error)
+}
+
+// KeySigner - signs locally using a service account private key
+type KeySigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+// NewKeySigner - accepts the service account email and its PEM encoded (PKCS1 or PKCS8) private key
+func NewKeySigner(email string, pemKey []byte) (*KeySigner, error) {
+	if len(email) == 0 || len(pemKey) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New(`private key is not PEM encoded`)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return &KeySigner{email: email, key: k}, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(`private key is not an RSA key`)
+	}
+	return &KeySigner{email: email, key: rk}, nil
+}
+
+// NewCredentialsSigner - accepts service account JSON credentials, as passed to NewCStore
+func NewCredentialsSigner(cred []byte) (*KeySigner, error) {
+	conf, err := google.JWTConfigFromJSON(cred)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySigner(conf.Email, conf.PrivateKey)
+}
+
+func (ks *KeySigner) Email() string {
+	return ks.email
+}
+
+func (ks *KeySigner) SignBytes(ctx context.Context, b []byte) ([]byte, error) {
+	sum := sha256.Sum256(b)
+	return rsa.SignPKCS1v15(rand.Reader, ks.key, crypto.SHA256, sum[:])
+}
+
+// IAMSigner - signs via the IAM Credentials signBlob API, the caller needs roles/iam.serviceAccountTokenCreator on the account
+type IAMSigner struct {
+	email   string
+	service *iamcredentials.Service
+}
+
+// NewIAMSigner - email is the service account to sign as, opts are passed to the IAM Credentials client
+func NewIAMSigner(ctx context.Context, email string, opts ...option.ClientOption) (*IAMSigner, error) {
+	if len(email) == 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	svc, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &IAMSigner{email: email, service: svc}, nil
+}
+
+func (is *IAMSigner) Email() string {
+	return is.email
+}
+
+func (is *IAMSigner) SignBytes(ctx context.Context, b []byte) ([]byte, error) {
+	req := &iamcredentials.SignBlobRequest{Payload: base64.StdEncoding.EncodeToString(b)}
+	resp, err := is.service.Projects.ServiceAccounts.SignBlob(`projects/-/serviceAccounts/`+is.email, req).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.SignedBlob)
+}
+
+// SetSigner - sets the Signer used for signed URLs & POST policies, replacing the default derived from the credentials
+func (cs *CStore) SetSigner(s Signer) {
+	cs.signer = s
+}
+
+// getSigner - the configured Signer, or one built from the credentials the store was created with
+func (cs *CStore) getSigner() (Signer, error) {
+	if cs.signer != nil {
+		return cs.signer, nil
+	}
+	if len(cs.credentials) == 0 {
+		return nil, errors.New(`no signer available: create the store with credentials or call SetSigner`)
+	}
+	return NewCredentialsSigner(cs.credentials)
+}
+
+// URLOptions - controls the generation of a signed URL
+type URLOptions struct {
+	// Method - GET (default), HEAD, PUT, POST or DELETE
+	Method  string
+	Expires time.Duration
+	// ContentType - when set, the client must send this Content-Type header
+	ContentType string
+	// Headers - extension headers the client must send, each in the form "name:value"
+	Headers []string
+	// MD5 - base64 encoded MD5 the client must send in the Content-MD5 header
+	MD5             string
+	QueryParameters url.Values
+	// Scheme - defaults to storage.SigningSchemeDefault (V2), V4 limits Expires to 7 days
+	Scheme storage.SigningScheme
+}
+
+// SignURL - create a signed, time limited url granting opts.Method access to the specified object
+func (cs *CStore) SignURL(ctx context.Context, name string, opts URLOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return ``, err
+	}
+	s, err := cs.getSigner()
+	if err != nil {
+		return ``, err
+	}
+	if len(opts.Method) == 0 {
+		opts.Method = `GET`
+	}
+	so := &storage.SignedURLOptions{
+		GoogleAccessID:  s.Email(),
+		SignBytes:       func(b []byte) ([]byte, error) { return s.SignBytes(ctx, b) },
+		Method:          opts.Method,
+		Expires:         time.Now().Add(opts.Expires),
+		ContentType:     opts.ContentType,
+		Headers:         opts.Headers,
+		MD5:             opts.MD5,
+		QueryParameters: opts.QueryParameters,
+		Scheme:          opts.Scheme,
+	}
+	return storage.SignedURL(cs.BucketName(), name, so)
+}
+
+// CreateUploadURL - create a V4 signed url allowing the object to be written with a single PUT.
+// the client must send the given Content-Type header
+func (cs *CStore) CreateUploadURL(ctx context.Context, minutes int, path string, contentType string) (string, error) {
+	return cs.SignURL(ctx, path, URLOptions{
+		Method:      `PUT`,
+		Expires:     time.Duration(minutes) * time.Minute,
+		ContentType: contentType,
+		Scheme:      storage.SigningSchemeV4,
+	})
+}
+
+// CreateResumableUploadURL - create a V4 signed url that starts a resumable upload.
+// the client POSTs to the url with the headers "x-goog-resumable: start" and the given Content-Type,
+// then uploads the content to the session URI returned in the Location header
+func (cs *CStore) CreateResumableUploadURL(ctx context.Context, minutes int, path string, contentType string) (string, error) {
+	return cs.SignURL(ctx, path, URLOptions{
+		Method:      `POST`,
+		Expires:     time.Duration(minutes) * time.Minute,
+		ContentType: contentType,
+		Headers:     []string{`x-goog-resumable:start`},
+		Scheme:      storage.SigningSchemeV4,
+	})
+}
+
+// PostPolicyOptions - constraints for a browser (HTML form) upload
+type PostPolicyOptions struct {
+	Expires time.Duration
+	// KeyIsPrefix - the name passed to CreatePostPolicy is a prefix, the form may supply any key beginning with it
+	KeyIsPrefix bool
+	// ContentType - exact content type the form must supply, or ContentTypePrefix e.g. "image/"
+	ContentType       string
+	ContentTypePrefix string
+	// MinSize / MaxSize - allowed content length range in bytes, ignored when MaxSize is zero
+	MinSize int64
+	MaxSize int64
+	// Metadata - custom metadata applied to the object, keys without the x-goog-meta- prefix
+	Metadata           map[string]string
+	CacheControl       string
+	ContentDisposition string
+	// SuccessStatus - status returned on success (200, 201 or 204), or SuccessRedirect a url to redirect to
+	SuccessStatus   int
+	SuccessRedirect string
+}
+
+// CreatePostPolicy - create a V4 signed POST policy document, allowing a browser to upload directly to the bucket.
+// the returned Fields must be included in the multipart form (before the file field) posted to URL
+func (cs *CStore) CreatePostPolicy(ctx context.Context, name string, opts PostPolicyOptions) (*storage.PostPolicyV4, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(name) == 0 || opts.Expires <= 0 {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	s, err := cs.getSigner()
+	if err != nil {
+		return nil, err
+	}
+	bucket := cs.BucketName()
+	now := time.Now().UTC()
+	fields := map[string]string{
+		`key`:               name,
+		`x-goog-date`:       now.Format(`20060102T150405Z`),
+		`x-goog-credential`: s.Email() + `/` + now.Format(`20060102`) + `/auto/storage/goog4_request`,
+		`x-goog-algorithm`:  `GOOG4-RSA-SHA256`,
+	}
+	conds := []interface{}{map[string]string{`bucket`: bucket}}
+	if opts.KeyIsPrefix {
+		conds = append(conds, []string{`starts-with`, `$key`, name})
+	} else {
+		conds = append(conds, map[string]string{`key`: name})
+	}
+	if len(opts.ContentType) > 0 {
+		fields[`Content-Type`] = opts.ContentType
+		conds = append(conds, map[string]string{`Content-Type`: opts.ContentType})
+	} else if len(opts.ContentTypePrefix) > 0 {
+		conds = append(conds, []string{`starts-with`, `$Content-Type`, opts.ContentTypePrefix})
+	}
+	if opts.MaxSize > 0 {
+		conds = append(conds, []interface{}{`content-length-range`, opts.MinSize, opts.MaxSize})
+	}
+	if len(opts.CacheControl) > 0 {
+		fields[`Cache-Control`] = opts.CacheControl
+	}
+	if len(opts.ContentDisposition) > 0 {
+		fields[`Content-Disposition`] = opts.ContentDisposition
+	}
+	for k, v := range opts.Metadata {
+		fields[`x-goog-meta-`+k] = v
+	}
+	if opts.SuccessStatus > 0 {
+		fields[`success_action_status`] = fmt.Sprint(opts.SuccessStatus)
+	}
+	if len(opts.SuccessRedirect) > 0 {
+		fields[`success_action_redirect`] = opts.SuccessRedirect
+	}
+	// every field other than key (already covered) must have a matching condition, in a stable order
+	var keys []string
+	for k := range fields {
+		if k != `key` && k != `Content-Type` {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conds = append(conds, map[string]string{k: fields[k]})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		`conditions`: conds,
+		`expiration`: now.Add(opts.Expires).Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	b64 := base64.StdEncoding.EncodeToString(policy)
+	sig, err := s.SignBytes(ctx, []byte(b64))
+	if err != nil {
+		return nil, err
+	}
+	fields[`policy`] = b64
+	fields[`x-goog-signature`] = hex.EncodeToString(sig)
+	u := url.URL{Scheme: `https`, Host: `storage.googleapis.com`, Path: `/` + bucket + `/`}
+	return &storage.PostPolicyV4{URL: u.String(), Fields: fields}, nil
+}
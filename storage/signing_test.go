@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"google.golang.org/api/option"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signerEmail = `tester@example.iam.gserviceaccount.com`
+
+// offlineStore - a CStore that can sign, but not reach GCS
+func offlineStore(t *testing.T) (*CStore, *rsa.PrivateKey) {
+	c, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	ks, err := NewKeySigner(signerEmail, pem.EncodeToMemory(&pem.Block{Type: `PRIVATE KEY`, Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &CStore{client: c, bucket: c.Bucket(`sample`)}
+	result.SetSigner(ks)
+	return result, key
+}
+
+func TestSignURL(t *testing.T) {
+	ocs, _ := offlineStore(t)
+	ctx := context.Background()
+
+	u, err := ocs.CreateUploadURL(ctx, 5, `uploads/a b.txt`, `text/plain`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu, _ := url.Parse(u)
+	q := pu.Query()
+	if q.Get(`X-Goog-Algorithm`) != `GOOG4-RSA-SHA256` || !strings.HasPrefix(q.Get(`X-Goog-Credential`), signerEmail) {
+		t.Errorf(`expected V4 url, got %s`, u)
+	}
+	if !strings.Contains(q.Get(`X-Goog-SignedHeaders`), `content-type`) {
+		t.Errorf(`content-type should be a signed header: %s`, u)
+	}
+
+	u, err = ocs.CreateResumableUploadURL(ctx, 5, `uploads/big.bin`, `application/octet-stream`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pu, _ = url.Parse(u); !strings.Contains(pu.Query().Get(`X-Goog-SignedHeaders`), `x-goog-resumable`) {
+		t.Errorf(`x-goog-resumable should be a signed header: %s`, u)
+	}
+
+	if _, err = ocs.SignURL(ctx, `a.txt`, URLOptions{Expires: 8 * 24 * time.Hour, Scheme: storage.SigningSchemeV4}); err == nil {
+		t.Error(`expected V4 expiry beyond 7 days to be rejected`)
+	}
+
+	// a store with no credentials and no signer
+	ocs.SetSigner(nil)
+	if _, err = ocs.CreateDownloadURL(5, `a.txt`); err == nil {
+		t.Error(`expected error without a signer`)
+	}
+}
+
+func TestCreatePostPolicy(t *testing.T) {
+	ocs, key := offlineStore(t)
+	pp, err := ocs.CreatePostPolicy(context.Background(), `uploads/`, PostPolicyOptions{
+		Expires:           10 * time.Minute,
+		KeyIsPrefix:       true,
+		ContentTypePrefix: `image/`,
+		MaxSize:           1 << 20,
+		Metadata:          map[string]string{`owner`: `test`},
+		SuccessStatus:     201,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp.URL != `https://storage.googleapis.com/sample/` {
+		t.Errorf(`unexpected url %s`, pp.URL)
+	}
+	if pp.Fields[`x-goog-meta-owner`] != `test` || pp.Fields[`success_action_status`] != `201` {
+		t.Errorf(`missing fields %v`, pp.Fields)
+	}
+
+	// signature covers the base64 policy
+	sig, _ := hex.DecodeString(pp.Fields[`x-goog-signature`])
+	sum := sha256.Sum256([]byte(pp.Fields[`policy`]))
+	if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Error(`bad signature`, err)
+	}
+
+	b, _ := base64.StdEncoding.DecodeString(pp.Fields[`policy`])
+	var policy struct {
+		Conditions []interface{} `json:"conditions"`
+		Expiration string        `json:"expiration"`
+	}
+	if err = json.Unmarshal(b, &policy); err != nil {
+		t.Fatal(err)
+	}
+	ps := string(b)
+	for _, want := range []string{`["starts-with","$key","uploads/"]`, `["starts-with","$Content-Type","image/"]`,
+		`["content-length-range",0,1048576]`, `{"x-goog-meta-owner":"test"}`, `{"bucket":"sample"}`} {
+		if !strings.Contains(ps, want) {
+			t.Errorf(`policy missing %s: %s`, want, ps)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+/*
+	rsync like synchronisation between a local directory and an ObjectStore prefix
+*/
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncDirection - which side of a Sync is the source
+type SyncDirection int
+
+const (
+	// SyncUpload - make the prefix match the local directory
+	SyncUpload SyncDirection = iota
+	// SyncDownload - make the local directory match the prefix
+	SyncDownload
+)
+
+// SyncAction - what Sync did (or would do) with a file
+type SyncAction string
+
+const (
+	SyncCopy   SyncAction = `copy`
+	SyncDelete SyncAction = `delete`
+)
+
+// SyncOptions - controls a Sync
+type SyncOptions struct {
+	Direction SyncDirection
+	// Checksum - compare content hashes rather than modification times, when sizes match
+	Checksum bool
+	// Delete - remove files from the destination that do not exist at the source
+	Delete bool
+	// DryRun - report the changes that would be made, without making them
+	DryRun bool
+	// Transfer - concurrency and retry settings for the copies and deletes
+	Transfer TransferOptions
+}
+
+// SyncChange - a single difference between source and destination. Name is relative to the directory / prefix
+type SyncChange struct {
+	Name   string
+	Action SyncAction
+	Reason string
+	Bytes  int64
+	Err    error
+}
+
+// SyncReport - outcome of a Sync, Changes are in name order
+type SyncReport struct {
+	Changes   []SyncChange
+	Unchanged int
+	Failed    int
+	DryRun    bool
+}
+
+// Err - nil if every change was made successfully
+func (sr *SyncReport) Err() error {
+	for _, c := range sr.Changes {
+		if c.Err != nil {
+			return errors.New(string(c.Action) + ` ` + c.Name + ` failed: ` + c.Err.Error())
+		}
+	}
+	return nil
+}
+
+type localInfo struct {
+	size  int64
+	mtime time.Time
+}
+
+// Sync - compares localDir with the objects below prefix, copying new or changed files in opts.Direction and optionally
+// deleting files missing from the source. Files are judged unchanged when their sizes match and either their hashes
+// match (opts.Checksum) or the destination is no older than the source
+func Sync(ctx context.Context, st ObjectStore, localDir string, prefix string, opts SyncOptions) (*SyncReport, error) {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := localFiles(localDir)
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]localInfo, len(files))
+	for _, f := range files {
+		fi, e := os.Stat(filepath.Join(localDir, filepath.FromSlash(f)))
+		if e != nil {
+			return nil, e
+		}
+		local[f] = localInfo{size: fi.Size(), mtime: fi.ModTime()}
+	}
+	l, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]storage.ObjectAttrs, len(l))
+	for _, oa := range l {
+		if rel := strings.TrimPrefix(oa.Name, prefix); len(rel) > 0 && !strings.HasSuffix(rel, `/`) {
+			remote[rel] = oa
+		}
+	}
+
+	report := &SyncReport{DryRun: opts.DryRun}
+	upload := opts.Direction == SyncUpload
+	for name, li := range local {
+		ra, ok := remote[name]
+		var reason string
+		switch {
+		case !ok:
+			reason = `missing`
+		case ra.Size != li.size:
+			reason = `size`
+		case opts.Checksum:
+			same, e := sameContent(filepath.Join(localDir, filepath.FromSlash(name)), &ra)
+			if e != nil {
+				return nil, e
+			}
+			if !same {
+				reason = `checksum`
+			}
+		case upload && li.mtime.After(ra.Updated), !upload && ra.Updated.After(li.mtime):
+			reason = `modified`
+		}
+		if len(reason) == 0 {
+			report.Unchanged++
+		} else if upload || ok {
+			report.Changes = append(report.Changes, SyncChange{Name: name, Action: SyncCopy, Reason: reason})
+		}
+		if !upload && !ok && opts.Delete {
+			report.Changes = append(report.Changes, SyncChange{Name: name, Action: SyncDelete, Reason: `extra`})
+		}
+	}
+	for name, ra := range remote {
+		if _, ok := local[name]; ok {
+			continue
+		}
+		if !upload {
+			report.Changes = append(report.Changes, SyncChange{Name: name, Action: SyncCopy, Reason: `missing`, Bytes: ra.Size})
+		} else if opts.Delete {
+			report.Changes = append(report.Changes, SyncChange{Name: name, Action: SyncDelete, Reason: `extra`})
+		}
+	}
+	sort.Slice(report.Changes, func(i, j int) bool { return report.Changes[i].Name < report.Changes[j].Name })
+	if opts.DryRun || len(report.Changes) == 0 {
+		return report, nil
+	}
+
+	// perform the copies and deletes using the transfer engine, one result per change
+	results := make([]TransferResult, len(report.Changes))
+	changes := make(map[*TransferResult]SyncChange, len(results))
+	for i, c := range report.Changes {
+		results[i] = TransferResult{Object: prefix + c.Name}
+		results[i].Local, results[i].Err = localName(localDir, c.Name)
+		changes[&results[i]] = c
+	}
+	runTransfers(ctx, results, opts.Transfer, func(ctx context.Context, r *TransferResult) error {
+		var err error
+		c := changes[r]
+		switch {
+		case c.Action == SyncDelete && upload:
+			err = st.Delete(ctx, r.Object)
+		case c.Action == SyncDelete:
+			err = removeLocal(localDir, r.Local)
+		case upload:
+			r.Bytes, err = uploadObject(ctx, st, r.Local, r.Object)
+		default:
+			if r.Bytes, err = downloadObject(ctx, st, r.Object, r.Local); err == nil {
+				// keep the local time in step with the object, so the next sync sees no change
+				mt := remote[c.Name].Updated
+				err = os.Chtimes(r.Local, mt, mt)
+			}
+		}
+		return err
+	})
+	for i := range results {
+		report.Changes[i].Err = results[i].Err
+		report.Changes[i].Bytes = results[i].Bytes
+		if results[i].Err != nil {
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+// removeLocal - delete a file, along with any directories below root it leaves empty
+func removeLocal(root string, p string) error {
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	root = filepath.Clean(root)
+	for d := filepath.Dir(p); d != root && strings.HasPrefix(d, root); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// sameContent - compares a local file with the object's MD5, or CRC32C for composite objects which have no MD5
+func sameContent(lp string, oa *storage.ObjectAttrs) (bool, error) {
+	f, err := os.Open(lp)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := md5.New()
+	c := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err = io.Copy(io.MultiWriter(h, c), f); err != nil {
+		return false, err
+	}
+	if len(oa.MD5) > 0 {
+		return bytes.Equal(h.Sum(nil), oa.MD5), nil
+	}
+	return c.Sum32() == oa.CRC32C, nil
+}
+
+// Sync - synchronise localDir with the objects below prefix, see the package level Sync
+func (cs *CStore) Sync(localDir string, prefix string, opts SyncOptions) (*SyncReport, error) {
+	return cs.SyncCtx(context.Background(), localDir, prefix, opts)
+}
+
+// SyncCtx - as Sync, bounded by ctx
+func (cs *CStore) SyncCtx(ctx context.Context, localDir string, prefix string, opts SyncOptions) (*SyncReport, error) {
+	return Sync(ctx, cs, localDir, prefix, opts)
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeLocal(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	_ = os.MkdirAll(filepath.Dir(p), 0755)
+	if e := ioutil.WriteFile(p, []byte(content), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return p
+}
+
+func TestSyncUpload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pa := writeLocal(t, dir, `a.txt`, `aaaa`)
+	writeLocal(t, dir, `d/b.txt`, `bbbb`)
+	ms := NewMemStore(`test`)
+	_ = ms.Write(ctx, `site/old.txt`, []byte(`old`), `text/plain`)
+
+	r, err := Sync(ctx, ms, dir, `site/`, SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Changes) != 3 || !r.DryRun {
+		t.Fatalf(`expected 3 changes, got %+v`, r.Changes)
+	}
+	if l, _ := ms.List(ctx, `site/`); len(l) != 1 {
+		t.Error(`dry run should not change the store`)
+	}
+
+	r, err = Sync(ctx, ms, dir, `site/`, SyncOptions{Delete: true})
+	if err != nil || r.Err() != nil {
+		t.Fatal(err, r.Err())
+	}
+	if l, _ := ms.List(ctx, `site/`); len(l) != 2 || l[0].Name != `site/a.txt` || l[1].Name != `site/d/b.txt` {
+		t.Errorf(`unexpected objects %v`, l)
+	}
+
+	// nothing has changed
+	if r, _ = Sync(ctx, ms, dir, `site/`, SyncOptions{Delete: true}); len(r.Changes) != 0 || r.Unchanged != 2 {
+		t.Errorf(`expected no changes, got %+v`, r.Changes)
+	}
+
+	// same size, older timestamp: only a checksum comparison sees the difference
+	writeLocal(t, dir, `a.txt`, `AAAA`)
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(pa, old, old)
+	if r, _ = Sync(ctx, ms, dir, `site/`, SyncOptions{}); len(r.Changes) != 0 {
+		t.Errorf(`expected no changes by time, got %+v`, r.Changes)
+	}
+	r, _ = Sync(ctx, ms, dir, `site/`, SyncOptions{Checksum: true})
+	if len(r.Changes) != 1 || r.Changes[0].Reason != `checksum` {
+		t.Fatalf(`expected checksum change, got %+v`, r.Changes)
+	}
+	if b, _ := ReadObject(ctx, ms, `site/a.txt`); string(b) != `AAAA` {
+		t.Errorf(`object not updated: %s`, b)
+	}
+}
+
+func TestSyncDownload(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStore(`test`)
+	_ = ms.Write(ctx, `site/a.txt`, []byte(`aaaa`), `text/plain`)
+	_ = ms.Write(ctx, `site/d/b.txt`, []byte(`bbbb`), `text/plain`)
+	dir := t.TempDir()
+	writeLocal(t, dir, `x/extra.txt`, `x`)
+
+	opts := SyncOptions{Direction: SyncDownload, Delete: true}
+	r, err := Sync(ctx, ms, dir, `site/`, opts)
+	if err != nil || r.Err() != nil {
+		t.Fatal(err, r.Err())
+	}
+	if len(r.Changes) != 3 {
+		t.Errorf(`expected 3 changes, got %+v`, r.Changes)
+	}
+	files, _ := localFiles(dir)
+	if len(files) != 2 || files[0] != `a.txt` || files[1] != `d/b.txt` {
+		t.Errorf(`unexpected local files %v`, files)
+	}
+	if _, e := os.Stat(filepath.Join(dir, `x`)); !os.IsNotExist(e) {
+		t.Error(`empty directory should have been removed`)
+	}
+	if r, _ = Sync(ctx, ms, dir, `site/`, opts); len(r.Changes) != 0 {
+		t.Errorf(`expected no changes, got %+v`, r.Changes)
+	}
+}
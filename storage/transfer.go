@@ -0,0 +1,277 @@
+package storage
+
+/*
+	concurrent upload / download of many objects between local disk and any ObjectStore
+	each file is transferred (and retried) independently, so a single failure does not abort the batch
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWorkers = 4
+
+// TransferOptions - controls a bulk upload or download
+type TransferOptions struct {
+	// Workers - number of files transferred concurrently, defaults to 4
+	Workers int
+	// Retries - number of further attempts made for a file after a failure. These are in addition to any retries
+	// made by the store itself, e.g. under a CStore's RetryPolicy, so a file may be attempted up to
+	// (Retries+1) x RetryPolicy.MaxAttempts times. Set the store's policy to NoRetry to leave retries to the transfer
+	Retries int
+	// RetryDelay - wait before the first retry, doubled for each subsequent retry. defaults to 1 second
+	RetryDelay time.Duration
+	// StripPrefix - downloads only, removed from the start of each object name to form the local path.
+	// the remainder of the name (including any folders) is preserved below the destination directory
+	StripPrefix string
+}
+
+// TransferResult - outcome for a single file
+type TransferResult struct {
+	Object string
+	Local  string
+	// Dest - the destination object, for copies within the cloud
+	Dest     string
+	Bytes    int64
+	Attempts int
+	Err      error
+}
+
+// TransferReport - outcome of a bulk transfer, Results are in the order the files were given
+type TransferReport struct {
+	Results []TransferResult
+	Failed  int
+	Bytes   int64
+}
+
+// Err - nil if every file was transferred, otherwise an error summarising the failures
+func (tr *TransferReport) Err() error {
+	if tr.Failed == 0 {
+		return nil
+	}
+	for _, r := range tr.Results {
+		if r.Err != nil {
+			return fmt.Errorf(`%d of %d transfers failed, first failure %s: %w`, tr.Failed, len(tr.Results), r.Object, r.Err)
+		}
+	}
+	return nil
+}
+
+func (to *TransferOptions) workers() int {
+	if to.Workers > 0 {
+		return to.Workers
+	}
+	return defaultWorkers
+}
+
+// transferRetryable - true for errors that may be resolved by trying the file again, those from a missing object,
+// failed precondition, lack of permission or a finished context are not
+func transferRetryable(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, storage.ErrObjectNotExist) && !errors.Is(err, ErrPrecondition) &&
+		!errors.Is(err, ErrPermission)
+}
+
+// runTransfers - performs fn for each result using a pool of workers, retrying failures as configured.
+// results that already hold an error are not attempted
+func runTransfers(ctx context.Context, results []TransferResult, opts TransferOptions, fn func(ctx context.Context, r *TransferResult) error) *TransferReport {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &results[i]
+				if r.Err != nil {
+					continue
+				}
+				delay := opts.RetryDelay
+				if delay <= 0 {
+					delay = time.Second
+				}
+				for {
+					r.Attempts++
+					r.Err = fn(ctx, r)
+					if r.Err == nil || r.Attempts > opts.Retries || !transferRetryable(ctx, r.Err) {
+						break
+					}
+					select {
+					case <-ctx.Done():
+					case <-time.After(delay):
+					}
+					delay *= 2
+				}
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := &TransferReport{Results: results}
+	for _, r := range results {
+		if r.Err != nil {
+			report.Failed++
+		} else {
+			report.Bytes += r.Bytes
+		}
+	}
+	return report
+}
+
+// Download - copy the named objects into destDir, preserving the folder structure below opts.StripPrefix
+func Download(ctx context.Context, st ObjectStore, objects []string, destDir string, opts TransferOptions) *TransferReport {
+	results := make([]TransferResult, len(objects))
+	for i, o := range objects {
+		results[i].Object = o
+		results[i].Local, results[i].Err = localName(destDir, strings.TrimPrefix(o, opts.StripPrefix))
+	}
+	return runTransfers(ctx, results, opts, func(ctx context.Context, r *TransferResult) error {
+		var err error
+		r.Bytes, err = downloadObject(ctx, st, r.Object, r.Local)
+		return err
+	})
+}
+
+// DownloadPrefix - copy every object below prefix into destDir, preserving the folder structure below prefix
+func DownloadPrefix(ctx context.Context, st ObjectStore, prefix string, destDir string, opts TransferOptions) (*TransferReport, error) {
+	l, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, oa := range l {
+		if !strings.HasSuffix(oa.Name, `/`) {
+			objects = append(objects, oa.Name)
+		}
+	}
+	opts.StripPrefix = prefix
+	return Download(ctx, st, objects, destDir, opts), nil
+}
+
+// UploadFiles - copy files (paths relative to srcDir, using either separator) to objects named prefix + path
+func UploadFiles(ctx context.Context, st ObjectStore, srcDir string, files []string, prefix string, opts TransferOptions) *TransferReport {
+	results := make([]TransferResult, len(files))
+	for i, f := range files {
+		results[i].Local = filepath.Join(srcDir, filepath.FromSlash(f))
+		results[i].Object = prefix + filepath.ToSlash(filepath.Clean(filepath.FromSlash(f)))
+	}
+	return runTransfers(ctx, results, opts, func(ctx context.Context, r *TransferResult) error {
+		var err error
+		r.Bytes, err = uploadObject(ctx, st, r.Local, r.Object)
+		return err
+	})
+}
+
+// UploadDir - copy every file below srcDir to objects named prefix + relative path
+func UploadDir(ctx context.Context, st ObjectStore, srcDir string, prefix string, opts TransferOptions) (*TransferReport, error) {
+	files, err := localFiles(srcDir)
+	if err != nil {
+		return nil, err
+	}
+	return UploadFiles(ctx, st, srcDir, files, prefix, opts), nil
+}
+
+// localFiles - paths ('/' separated) of all regular files below dir, relative to dir
+func localFiles(dir string) ([]string, error) {
+	var result []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		result = append(result, filepath.ToSlash(rel))
+		return nil
+	})
+	return result, err
+}
+
+// localName - the path within dir for the object name rel, which must not escape dir
+func localName(dir string, rel string) (string, error) {
+	clean := path.Clean(`/` + rel)
+	if len(rel) == 0 || clean == `/` || strings.HasSuffix(rel, `/`) {
+		return ``, errors.New(`no file name for object: ` + rel)
+	}
+	if strings.Contains(`/`+rel+`/`, `/../`) {
+		return ``, errors.New(`object name escapes destination: ` + rel)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// downloadObject - stream an object to a local file, the file is only replaced once the download completes
+func downloadObject(ctx context.Context, st ObjectStore, name string, lp string) (int64, error) {
+	r, _, err := st.NewReader(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if err = os.MkdirAll(filepath.Dir(lp), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(lp), `.download-`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), lp)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return n, err
+	}
+	return n, nil
+}
+
+// streamWriter - implemented by stores able to upload without holding the whole file in memory
+type streamWriter interface {
+	WriteFrom(ctx context.Context, fn string, r io.Reader, opts *WriteOptions) (int64, error)
+}
+
+// uploadObject - copy a local file to an object
+func uploadObject(ctx context.Context, st ObjectStore, lp string, name string) (int64, error) {
+	if sw, ok := st.(streamWriter); ok {
+		f, err := os.Open(lp)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return sw.WriteFrom(ctx, name, f, &WriteOptions{InferContentType: true})
+	}
+	b, err := ioutil.ReadFile(lp)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), st.Write(ctx, name, b, DetectContentType(name, b))
+}
+
+// DownloadAll - concurrent download of files to dest, preserving their folder structure below opts.StripPrefix
+func (cs *CStore) DownloadAll(ctx context.Context, files []string, dest string, opts TransferOptions) *TransferReport {
+	return Download(ctx, cs, files, dest, opts)
+}
+
+// UploadDir - concurrent upload of every file below srcDir to objects named prefix + relative path
+func (cs *CStore) UploadDir(ctx context.Context, srcDir string, prefix string, opts TransferOptions) (*TransferReport, error) {
+	return UploadDir(ctx, cs, srcDir, prefix, opts)
+}
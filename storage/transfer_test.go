@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	files := []string{`a/f1.txt`, `b/f1.txt`, `f2.json`}
+	for _, f := range files {
+		p := filepath.Join(src, filepath.FromSlash(f))
+		_ = os.MkdirAll(filepath.Dir(p), 0755)
+		if e := ioutil.WriteFile(p, []byte(f), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	ms := NewMemStore(`test`)
+	rep, err := UploadDir(ctx, ms, src, `up/`, TransferOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Err() != nil || len(rep.Results) != 3 {
+		t.Fatal(`upload failed`, rep.Err(), len(rep.Results))
+	}
+	if a, e := ms.Attrs(ctx, `up/f2.json`); e != nil || a.ContentType != `application/json` {
+		t.Error(`unexpected attributes`, a, e)
+	}
+
+	// same named files in different folders must not collide
+	dest := t.TempDir()
+	rep, err = DownloadPrefix(ctx, ms, `up/`, dest, TransferOptions{})
+	if err != nil || rep.Err() != nil {
+		t.Fatal(err, rep.Err())
+	}
+	for _, f := range files {
+		b, e := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(f)))
+		if e != nil || string(b) != f {
+			t.Errorf(`unexpected content for %s: %s %v`, f, b, e)
+		}
+	}
+	if rep.Bytes != int64(len(files[0])+len(files[1])+len(files[2])) {
+		t.Errorf(`unexpected byte count %d`, rep.Bytes)
+	}
+
+	// a missing object or unsafe name fails individually, without stopping the batch
+	rep = Download(ctx, ms, []string{`up/a/f1.txt`, `up/missing.txt`, `../escape.txt`}, t.TempDir(), TransferOptions{Retries: 2})
+	if rep.Failed != 2 || rep.Results[0].Err != nil {
+		t.Errorf(`expected 2 failures, got %d`, rep.Failed)
+	}
+	if rep.Results[1].Attempts != 1 {
+		t.Errorf(`missing objects should not be retried, got %d attempts`, rep.Results[1].Attempts)
+	}
+	if rep.Results[2].Attempts != 0 {
+		t.Error(`unsafe names should not be attempted`)
+	}
+	if rep.Err() == nil {
+		t.Error(`expected an error summary`)
+	}
+}
+
+func TestTransferRetry(t *testing.T) {
+	var calls int32
+	results := make([]TransferResult, 3)
+	rep := runTransfers(context.Background(), results, TransferOptions{Retries: 2, RetryDelay: time.Millisecond},
+		func(ctx context.Context, r *TransferResult) error {
+			if atomic.AddInt32(&calls, 1) <= 2 {
+				return errors.New(`transient`)
+			}
+			return nil
+		})
+	if rep.Err() != nil {
+		t.Error(rep.Err())
+	}
+	if calls != 5 {
+		t.Errorf(`expected 5 calls, got %d`, calls)
+	}
+}
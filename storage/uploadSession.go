@@ -0,0 +1,324 @@
+package storage
+
+/*
+	resumable upload sessions
+	a session is identified by a URI, valid for a week, that may be persisted (e.g. with Documents) so that an upload
+	interrupted by a restart can be continued by another process from the offset GCS has committed, rather than
+	starting again from zero
+*/
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// uploadChunkAlign - chunks other than the last must be a multiple of 256KiB
+	uploadChunkAlign = 256 << 10
+	// DefaultUploadChunkSize - the amount sent per request by UploadSession.Upload
+	DefaultUploadChunkSize = 16 << 20
+	// defaultEndpoint - the storage api, when no endpoint (or emulator) is configured
+	defaultEndpoint = `https://storage.googleapis.com/storage/v1/`
+)
+
+// UploadSession - a resumable upload of Object. Only URI & Object need to be kept to resume the upload,
+// the session may be marshalled to JSON and reattached with CStore.UploadSession
+type UploadSession struct {
+	URI    string
+	Object string
+	// ChunkSize - bytes sent per request, rounded down to a multiple of 256KiB. Zero for DefaultUploadChunkSize
+	ChunkSize int `json:",omitempty"`
+	cs        *CStore
+}
+
+// StartUpload - begins a resumable upload of name with the attributes given in opts (which may be nil).
+// Gzip is not supported, as the offsets would be those of the compressed content. Conditions are checked when the
+// upload completes. An encryption key (see WithEncryptionKey) must also be supplied to each later call
+func (cs *CStore) StartUpload(ctx context.Context, name string, opts *WriteOptions) (*UploadSession, error) {
+	if len(name) == 0 || (opts != nil && opts.Gzip) {
+		return nil, errors.New(`invalid parameter(s)`)
+	}
+	hc, base, err := cs.sessionClient()
+	if err != nil {
+		return nil, err
+	}
+	meta := raw.Object{Name: name}
+	if opts != nil {
+		meta.ContentType = opts.ContentType
+		if len(meta.ContentType) == 0 && opts.InferContentType {
+			meta.ContentType = DefaultContentTypes.ByName(name)
+		}
+		meta.Metadata = opts.Metadata
+		meta.CacheControl = opts.CacheControl
+		meta.ContentDisposition = opts.ContentDisposition
+		meta.ContentEncoding = opts.ContentEncoding
+		meta.StorageClass = opts.StorageClass
+		meta.KmsKeyName = opts.KMSKeyName
+	}
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{`uploadType`: {`resumable`}, `name`: {name}}
+	if len(cs.userProject) > 0 {
+		q.Set(`userProject`, cs.userProject)
+	}
+	if opts != nil && opts.Conditions != nil {
+		c := opts.Conditions
+		if c.DoesNotExist {
+			q.Set(`ifGenerationMatch`, `0`)
+		} else if c.GenerationMatch != 0 {
+			q.Set(`ifGenerationMatch`, strconv.FormatInt(c.GenerationMatch, 10))
+		}
+		if c.MetagenerationMatch != 0 {
+			q.Set(`ifMetagenerationMatch`, strconv.FormatInt(c.MetagenerationMatch, 10))
+		}
+	}
+	u := base + `b/` + url.PathEscape(cs.BucketName()) + `/o?` + q.Encode()
+
+	var uri string
+	err = cs.retry(ctx, name, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(`Content-Type`, `application/json; charset=UTF-8`)
+		if len(meta.ContentType) > 0 {
+			req.Header.Set(`X-Upload-Content-Type`, meta.ContentType)
+		}
+		cs.setKeyHeaders(ctx, req)
+		resp, err := hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		if uri = resp.Header.Get(`Location`); len(uri) == 0 {
+			return errors.New(`no session uri returned for upload of ` + name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, classify(name, err)
+	}
+	return &UploadSession{URI: uri, Object: name, cs: cs}, nil
+}
+
+// UploadSession - reattaches to a session started by StartUpload, possibly in another process
+func (cs *CStore) UploadSession(uri, name string) *UploadSession {
+	return &UploadSession{URI: uri, Object: name, cs: cs}
+}
+
+// Offset - the number of bytes committed so far, and the attributes of the object once the upload is complete.
+// An expired or cancelled session is reported as ErrNotFound
+func (s *UploadSession) Offset(ctx context.Context) (int64, *storage.ObjectAttrs, error) {
+	var off int64
+	var a *storage.ObjectAttrs
+	err := s.cs.retry(ctx, s.Object, func(ctx context.Context) error {
+		var err error
+		off, a, err = s.send(ctx, `bytes */*`, nil)
+		return err
+	})
+	return off, a, err
+}
+
+// Upload - sends the content of r from the committed offset, returning the attributes of the new object.
+// r must hold the complete content, so an upload continued by a new process simply passes the same file.
+// Failed requests are retried under the store's retry policy, resuming from the offset then committed
+func (s *UploadSession) Upload(ctx context.Context, r io.ReadSeeker) (*storage.ObjectAttrs, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	chunk := int64(s.ChunkSize) / uploadChunkAlign * uploadChunkAlign
+	if chunk <= 0 {
+		chunk = DefaultUploadChunkSize
+	}
+	var buf []byte
+	off := int64(-1) // unknown
+	var a *storage.ObjectAttrs
+	for a == nil {
+		err = s.cs.retry(ctx, s.Object, func(ctx context.Context) error {
+			var err error
+			if off < 0 {
+				if off, a, err = s.send(ctx, `bytes */*`, nil); err != nil || a != nil {
+					off = -1
+					return err
+				}
+			}
+			if off > size {
+				return fmt.Errorf(`%d bytes already committed, content of %s is only %d bytes`, off, s.Object, size)
+			}
+			n := size - off
+			if n > chunk {
+				n = chunk
+			}
+			cr := fmt.Sprintf(`bytes */%d`, size)
+			if int64(cap(buf)) < n {
+				buf = make([]byte, n)
+			}
+			if n > 0 {
+				cr = fmt.Sprintf(`bytes %d-%d/%d`, off, off+n-1, size)
+				if _, err = r.Seek(off, io.SeekStart); err == nil {
+					_, err = io.ReadFull(r, buf[:n])
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if off, a, err = s.send(ctx, cr, buf[:n]); err != nil {
+				off = -1
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Cancel - abandons the upload, the session can no longer be used
+func (s *UploadSession) Cancel(ctx context.Context) error {
+	hc, _, err := s.cs.sessionClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.URI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// GCS reports a cancelled upload with the non standard 499
+	if resp.StatusCode == 499 {
+		return nil
+	}
+	return s.classify(googleapi.CheckResponse(resp))
+}
+
+// send - puts content at the Content-Range cr, returning the committed offset, or the object attributes once complete
+func (s *UploadSession) send(ctx context.Context, cr string, content []byte) (int64, *storage.ObjectAttrs, error) {
+	hc, _, err := s.cs.sessionClient()
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.URI, bytes.NewReader(content))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(`Content-Range`, cr)
+	// as for the storage client, incomplete uploads are reported as 200 to avoid 308 being treated as a redirect
+	req.Header.Set(`X-GUploader-No-308`, `yes`)
+	s.cs.setKeyHeaders(ctx, req)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPermanentRedirect || resp.Header.Get(`X-Http-Status-Code-Override`) == `308` {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		// Range is absent until the first byte is committed
+		var last int64 = -1
+		if rg := resp.Header.Get(`Range`); len(rg) > 0 {
+			if _, err = fmt.Sscanf(rg, `bytes=0-%d`, &last); err != nil {
+				return 0, nil, errors.New(`invalid upload range: ` + rg)
+			}
+		}
+		return last + 1, nil, nil
+	}
+	if err = googleapi.CheckResponse(resp); err != nil {
+		return 0, nil, s.classify(err)
+	}
+	var o raw.Object
+	if err = json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return 0, nil, err
+	}
+	a, err := s.cs.object(ctx, s.Object).Generation(o.Generation).Attrs(ctx)
+	if err != nil {
+		return 0, nil, classify(s.Object, err)
+	}
+	return a.Size, a, nil
+}
+
+// classify - as the package level classify, an expired session (410) is also reported as ErrNotFound
+func (s *UploadSession) classify(err error) error {
+	var ge *googleapi.Error
+	if errors.As(err, &ge) && ge.Code == http.StatusGone {
+		return &Error{Object: s.Object, Kind: ErrNotFound, Err: err}
+	}
+	return classify(s.Object, err)
+}
+
+// setKeyHeaders - the customer supplied encryption key for ctx, if any, which must accompany every session request
+func (cs *CStore) setKeyHeaders(ctx context.Context, req *http.Request) {
+	k := cs.encryptionKey(ctx)
+	if k == nil {
+		return
+	}
+	sum := sha256.Sum256(k)
+	req.Header.Set(`X-Goog-Encryption-Algorithm`, `AES256`)
+	req.Header.Set(`X-Goog-Encryption-Key`, base64.StdEncoding.EncodeToString(k))
+	req.Header.Set(`X-Goog-Encryption-Key-Sha256`, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// sessionClient - an http client authorised as the storage client is, and the base url for uploads.
+// The storage client does not expose its own, so one is created from the same options on first use
+func (cs *CStore) sessionClient() (*http.Client, string, error) {
+	cs.sessionMu.Lock()
+	defer cs.sessionMu.Unlock()
+	if cs.sessionHC != nil {
+		return cs.sessionHC, cs.uploadBase, nil
+	}
+	if !cs.ownsClient {
+		return nil, ``, errors.New(`upload sessions need the client options, which are not known for a store created WithClient`)
+	}
+	// as for the storage client, an emulator given by STORAGE_EMULATOR_HOST is used anonymously
+	endpoint := cs.endpoint
+	auth := option.WithScopes(storage.ScopeFullControl)
+	if host := os.Getenv(`STORAGE_EMULATOR_HOST`); len(host) > 0 {
+		if !strings.Contains(host, `://`) {
+			host = `http://` + host
+		}
+		auth = option.WithoutAuthentication()
+		if len(endpoint) == 0 {
+			endpoint = strings.TrimSuffix(host, `/`) + `/storage/v1/`
+		}
+	}
+	if len(endpoint) == 0 {
+		endpoint = defaultEndpoint
+	}
+	opts := append([]option.ClientOption{auth}, cs.options...)
+	// the client outlives any one call, so is not bound to a caller's context
+	hc, _, err := htransport.NewClient(context.Background(), append(opts, option.WithEndpoint(endpoint))...)
+	if err != nil {
+		return nil, ``, err
+	}
+	base := strings.TrimSuffix(endpoint, `/`)
+	if i := strings.LastIndex(base, `/storage/v1`); i >= 0 {
+		base = base[:i] + `/upload` + base[i:]
+	}
+	cs.sessionHC, cs.uploadBase = hc, base+`/`
+	return cs.sessionHC, cs.uploadBase, nil
+}
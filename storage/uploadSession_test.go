@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/storagetest"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var errInterrupted = errors.New(`interrupted`)
+
+// failingReader - fails once more than limit bytes have been read
+type failingReader struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	pos, _ := fr.Seek(0, io.SeekCurrent)
+	if pos+int64(len(p)) > fr.limit {
+		return 0, errInterrupted
+	}
+	return fr.Reader.Read(p)
+}
+
+func Test_UploadSession(t *testing.T) {
+	srv := storagetest.NewServer(`sessions`)
+	defer srv.Close()
+	ctx := context.Background()
+	a, e := NewCStoreWith(ctx, `sessions`, WithEmulator(srv.URL))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer a.Close()
+
+	content := make([]byte, 600<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+	s, e := a.StartUpload(ctx, `big.bin`, &WriteOptions{ContentType: `application/x-test`, Metadata: map[string]string{`k`: `v`}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.ChunkSize = 256 << 10
+	if _, e = s.Upload(ctx, &failingReader{Reader: bytes.NewReader(content), limit: 300 << 10}); !errors.Is(e, errInterrupted) {
+		t.Fatal(`expected interrupted upload, got`, e)
+	}
+	persisted, _ := json.Marshal(s)
+
+	// a new process resumes from the committed offset
+	b, e := NewCStoreWith(ctx, `sessions`, WithEmulator(srv.URL))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	var saved UploadSession
+	if e = json.Unmarshal(persisted, &saved); e != nil {
+		t.Fatal(e)
+	}
+	s2 := b.UploadSession(saved.URI, saved.Object)
+	if off, oa, e := s2.Offset(ctx); e != nil || oa != nil || off != 256<<10 {
+		t.Fatal(`unexpected offset`, off, oa, e)
+	}
+	oa, e := s2.Upload(ctx, bytes.NewReader(content))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if oa.Size != int64(len(content)) || oa.ContentType != `application/x-test` || oa.Metadata[`k`] != `v` {
+		t.Errorf(`unexpected attributes %+v`, oa)
+	}
+	if got, _ := ReadObject(ctx, b, `big.bin`); !bytes.Equal(got, content) {
+		t.Error(`content differs`)
+	}
+	if off, oa2, e := s2.Offset(ctx); e != nil || oa2 == nil || off != int64(len(content)) || oa2.Generation != oa.Generation {
+		t.Error(`expected completed session`, off, oa2, e)
+	}
+
+	// the condition is checked on completion
+	s3, e := a.StartUpload(ctx, `big.bin`, &WriteOptions{Conditions: &storage.Conditions{DoesNotExist: true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s3.Upload(ctx, bytes.NewReader([]byte(`x`))); !errors.Is(e, ErrPrecondition) {
+		t.Error(`expected ErrPrecondition, got`, e)
+	}
+
+	s4, e := a.StartUpload(ctx, `cancelled.bin`, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = s4.Cancel(ctx); e != nil {
+		t.Error(e)
+	}
+	if _, _, e = s4.Offset(ctx); !errors.Is(e, ErrNotFound) {
+		t.Error(`expected ErrNotFound, got`, e)
+	}
+
+	// an encryption key accompanies each request
+	key := bytes.Repeat([]byte{7}, EncryptionKeySize)
+	kctx := WithEncryptionKey(ctx, key)
+	s5, e := a.StartUpload(kctx, `secret.bin`, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s5.Upload(kctx, bytes.NewReader(content[:10])); e != nil {
+		t.Fatal(e)
+	}
+	if got, e := ReadObject(kctx, a, `secret.bin`); e != nil || !bytes.Equal(got, content[:10]) {
+		t.Error(`unexpected encrypted content`, e)
+	}
+
+	c, e := NewCStoreWith(ctx, `sessions`, WithClient(a.Client()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.StartUpload(ctx, `x.bin`, nil); e == nil {
+		t.Error(`expected an error for a store without client options`)
+	}
+}
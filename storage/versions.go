@@ -0,0 +1,68 @@
+package storage
+
+/*
+	access to every generation of objects within a bucket that has versioning enabled
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"sort"
+)
+
+// ListVersions - all generations of the named object, newest first. Noncurrent generations have Deleted set
+func (cs *CStore) ListVersions(ctx context.Context, name string) ([]storage.ObjectAttrs, error) {
+	p, err := cs.ListAll(ctx, ListOptions{Prefix: name, Versions: true})
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.ObjectAttrs
+	for _, oa := range p.Objects {
+		if oa.Name == name {
+			result = append(result, oa)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Generation > result[j].Generation })
+	return result, nil
+}
+
+// GetVersionReader - remember to close the Reader after use. reads a specific generation of the object,
+// which need not be the live one. The default timeout applies to opening the reader only
+func (cs *CStore) GetVersionReader(ctx context.Context, name string, gen int64) (*storage.Reader, error) {
+	if gen <= 0 {
+		return nil, errors.New(`invalid generation`)
+	}
+	oh := cs.object(ctx, name).Generation(gen)
+	var r *storage.Reader
+	// the reader is opened with ctx rather than the attempt context, as it outlives this call
+	err := cs.retry(ctx, name, func(context.Context) error {
+		var err error
+		r, err = oh.NewReader(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RestoreVersion - makes a copy of generation gen the live version of the object. The restored copy is a new
+// generation, the generation it replaces remains as a noncurrent version
+func (cs *CStore) RestoreVersion(ctx context.Context, name string, gen int64) (*storage.ObjectAttrs, error) {
+	if gen <= 0 {
+		return nil, errors.New(`invalid generation`)
+	}
+	src := cs.object(ctx, name).Generation(gen)
+	c := cs.copier(src, cs.object(ctx, name), nil)
+	return cs.runCopier(ctx, c, name)
+}
+
+// DeleteVersion - permanently deletes a single generation of the object, live or noncurrent
+func (cs *CStore) DeleteVersion(ctx context.Context, name string, gen int64) error {
+	if gen <= 0 {
+		return errors.New(`invalid generation`)
+	}
+	return cs.retry(ctx, name, func(ctx context.Context) error {
+		return cs.bucket.Object(name).Generation(gen).Delete(ctx)
+	})
+}
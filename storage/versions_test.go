@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_Versions(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	if a, e := cs.BucketAttrs(ctx); e != nil || !a.VersioningEnabled {
+		t.Skip(`test bucket does not have versioning enabled`, e)
+	}
+	fn := testPath + `versioned.txt`
+	a1, e := cs.WriteObject(ctx, fn, []byte(`v1`), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = cs.WriteObject(ctx, fn, []byte(`v2`), nil); e != nil {
+		t.Fatal(e)
+	}
+	v, e := cs.ListVersions(ctx, fn)
+	if e != nil || len(v) != 2 || v[1].Generation != a1.Generation || v[1].Deleted.IsZero() {
+		t.Fatalf(`unexpected versions %v %v`, v, e)
+	}
+
+	r, e := cs.GetVersionReader(ctx, fn, a1.Generation)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != `v1` {
+		t.Errorf(`expected v1, got %s`, b)
+	}
+
+	if _, e = cs.RestoreVersion(ctx, fn, a1.Generation); e != nil {
+		t.Fatal(e)
+	}
+	if b, _ = ReadObject(ctx, cs, fn); string(b) != `v1` {
+		t.Errorf(`expected restored v1, got %s`, b)
+	}
+
+	v, _ = cs.ListVersions(ctx, fn)
+	if len(v) != 3 {
+		t.Errorf(`expected 3 versions, got %d`, len(v))
+	}
+	for _, oa := range v {
+		if e = cs.DeleteVersion(ctx, fn, oa.Generation); e != nil {
+			t.Error(e)
+		}
+	}
+	if v, _ = cs.ListVersions(ctx, fn); len(v) != 0 {
+		t.Errorf(`expected no versions, got %d`, len(v))
+	}
+}
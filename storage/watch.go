@@ -0,0 +1,230 @@
+package storage
+
+/*
+	polling change detection for the objects below a prefix, without requiring Pub/Sub notifications
+*/
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cambefus/gcp_go_utils/util"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// WatchEventType - the kind of change detected
+type WatchEventType int
+
+const (
+	ObjectCreated WatchEventType = iota
+	ObjectUpdated
+	ObjectDeleted
+	// WatchError - a poll (or checkpoint save) failed, Err holds the cause. The watcher keeps polling
+	WatchError
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case ObjectCreated:
+		return `created`
+	case ObjectUpdated:
+		return `updated`
+	case ObjectDeleted:
+		return `deleted`
+	}
+	return `error`
+}
+
+// WatchEvent - a single change. Attrs is nil for deletions and errors
+type WatchEvent struct {
+	Type  WatchEventType
+	Name  string
+	Attrs *storage.ObjectAttrs
+	Err   error
+}
+
+// ObjectVersion - the state of an object recorded in a watch snapshot
+type ObjectVersion struct {
+	Generation     int64 `json:"g"`
+	Metageneration int64 `json:"m"`
+}
+
+// WatchCheckpoint - persists the snapshot of object versions between polls, and across restarts
+type WatchCheckpoint interface {
+	// Load - returns nil (and no error) if no checkpoint has been saved yet
+	Load(ctx context.Context) (map[string]ObjectVersion, error)
+	Save(ctx context.Context, snapshot map[string]ObjectVersion) error
+}
+
+// WatchOptions - controls a watcher
+type WatchOptions struct {
+	// Checkpoint - optional, where the snapshot is kept. It must not be stored below the watched prefix
+	Checkpoint WatchCheckpoint
+	// EmitExisting - on a first run (no checkpoint) report every existing object as created,
+	// rather than silently taking those present when Watch returns as the starting point
+	EmitExisting bool
+}
+
+// Watch - polls the objects below prefix every interval, sending a created, updated or deleted event for each change.
+// Events are unbuffered, the snapshot is only checkpointed once all the events from a poll have been received, so after
+// a restart events are never skipped, though those from an interrupted poll may be repeated.
+// The channel is closed when ctx is done
+func Watch(ctx context.Context, st ObjectStore, prefix string, interval time.Duration, opts WatchOptions) (<-chan WatchEvent, error) {
+	if interval <= 0 {
+		return nil, errors.New(`invalid interval`)
+	}
+	var snapshot map[string]ObjectVersion
+	if opts.Checkpoint != nil {
+		var err error
+		if snapshot, err = opts.Checkpoint.Load(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if snapshot == nil && !opts.EmitExisting {
+		// first run, the objects present now are the starting point
+		l, err := st.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = make(map[string]ObjectVersion, len(l))
+		for _, oa := range l {
+			snapshot[oa.Name] = ObjectVersion{Generation: oa.Generation, Metageneration: oa.Metageneration}
+		}
+		if opts.Checkpoint != nil {
+			if err = opts.Checkpoint.Save(ctx, snapshot); err != nil {
+				return nil, err
+			}
+		}
+	}
+	saved := snapshot != nil
+	if snapshot == nil {
+		snapshot = make(map[string]ObjectVersion)
+	}
+
+	ch := make(chan WatchEvent)
+	go func() {
+		defer close(ch)
+		send := func(e WatchEvent) bool {
+			select {
+			case ch <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			l, err := st.List(ctx, prefix)
+			if err != nil {
+				if ctx.Err() != nil || !send(WatchEvent{Type: WatchError, Err: err}) {
+					return
+				}
+			} else {
+				current := make(map[string]ObjectVersion, len(l))
+				var events []WatchEvent
+				for i := range l {
+					oa := &l[i]
+					v := ObjectVersion{Generation: oa.Generation, Metageneration: oa.Metageneration}
+					current[oa.Name] = v
+					if old, ok := snapshot[oa.Name]; !ok {
+						events = append(events, WatchEvent{Type: ObjectCreated, Name: oa.Name, Attrs: oa})
+					} else if old != v {
+						events = append(events, WatchEvent{Type: ObjectUpdated, Name: oa.Name, Attrs: oa})
+					}
+				}
+				for n := range snapshot {
+					if _, ok := current[n]; !ok {
+						events = append(events, WatchEvent{Type: ObjectDeleted, Name: n})
+					}
+				}
+				sort.SliceStable(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+				for _, e := range events {
+					if !send(e) {
+						return
+					}
+				}
+				snapshot = current
+				if opts.Checkpoint != nil && (len(events) > 0 || !saved) {
+					if err = opts.Checkpoint.Save(ctx, snapshot); err == nil {
+						saved = true
+					} else if !send(WatchEvent{Type: WatchError, Err: err}) {
+						return
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Watch - see the package level Watch, events are not checkpointed
+func (cs *CStore) Watch(ctx context.Context, prefix string, interval time.Duration) (<-chan WatchEvent, error) {
+	return Watch(ctx, cs, prefix, interval, WatchOptions{})
+}
+
+// WatchWith - see the package level Watch
+func (cs *CStore) WatchWith(ctx context.Context, prefix string, interval time.Duration, opts WatchOptions) (<-chan WatchEvent, error) {
+	return Watch(ctx, cs, prefix, interval, opts)
+}
+
+// FileCheckpoint - keeps the watch snapshot in a local JSON file
+type FileCheckpoint string
+
+func (fc FileCheckpoint) Load(ctx context.Context) (map[string]ObjectVersion, error) {
+	b, err := ioutil.ReadFile(string(fc))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]ObjectVersion)
+	return result, json.Unmarshal(b, &result)
+}
+
+func (fc FileCheckpoint) Save(ctx context.Context, snapshot map[string]ObjectVersion) error {
+	b, err := util.JSONMarshalNoEscape(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := string(fc) + `.tmp`
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(fc))
+}
+
+// ObjectCheckpoint - keeps the watch snapshot as a JSON object within a store
+type ObjectCheckpoint struct {
+	Store ObjectStore
+	Name  string
+}
+
+func (oc ObjectCheckpoint) Load(ctx context.Context) (map[string]ObjectVersion, error) {
+	b, err := ReadObject(ctx, oc.Store, oc.Name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]ObjectVersion)
+	return result, json.Unmarshal(b, &result)
+}
+
+func (oc ObjectCheckpoint) Save(ctx context.Context, snapshot map[string]ObjectVersion) error {
+	b, err := util.JSONMarshalNoEscape(snapshot)
+	if err != nil {
+		return err
+	}
+	return oc.Store.Write(ctx, oc.Name, b, `application/json`)
+}
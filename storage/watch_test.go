@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextEvent - waits briefly for the next event from the watcher
+func nextEvent(t *testing.T, ch <-chan WatchEvent) WatchEvent {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal(`timed out waiting for event`)
+	}
+	return WatchEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	ms := NewMemStore(`test`)
+	bg := context.Background()
+	_ = ms.Write(bg, `in/existing.txt`, []byte(`x`), `text/plain`)
+	cp := FileCheckpoint(filepath.Join(t.TempDir(), `watch.json`))
+
+	ctx, cancel := context.WithCancel(bg)
+	ch, err := Watch(ctx, ms, `in/`, 10*time.Millisecond, WatchOptions{Checkpoint: cp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the existing object is the baseline, so the first event is the new object
+	_ = ms.Write(bg, `in/new.txt`, []byte(`x`), `text/plain`)
+	if e := nextEvent(t, ch); e.Type != ObjectCreated || e.Name != `in/new.txt` || e.Attrs == nil {
+		t.Errorf(`unexpected event %+v`, e)
+	}
+	_ = ms.Write(bg, `in/existing.txt`, []byte(`y`), `text/plain`)
+	if e := nextEvent(t, ch); e.Type != ObjectUpdated || e.Name != `in/existing.txt` {
+		t.Errorf(`unexpected event %+v`, e)
+	}
+	_ = ms.Write(bg, `out/ignored.txt`, []byte(`x`), `text/plain`)
+	_ = ms.Delete(bg, `in/new.txt`)
+	if e := nextEvent(t, ch); e.Type != ObjectDeleted || e.Name != `in/new.txt` {
+		t.Errorf(`unexpected event %+v`, e)
+	}
+	cancel()
+	for range ch {
+	}
+
+	// a restart resumes from the checkpoint, reporting only what changed while stopped
+	_ = ms.Write(bg, `in/later.txt`, []byte(`x`), `text/plain`)
+	ctx, cancel = context.WithCancel(bg)
+	defer cancel()
+	if ch, err = Watch(ctx, ms, `in/`, 10*time.Millisecond, WatchOptions{Checkpoint: cp}); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, ch); e.Type != ObjectCreated || e.Name != `in/later.txt` {
+		t.Errorf(`unexpected event after restart %+v`, e)
+	}
+}
+
+func TestWatchEmitExisting(t *testing.T) {
+	ms := NewMemStore(`test`)
+	bg := context.Background()
+	_ = ms.Write(bg, `in/a.txt`, []byte(`x`), `text/plain`)
+	cp := ObjectCheckpoint{Store: ms, Name: `checkpoints/in.json`}
+	ctx, cancel := context.WithCancel(bg)
+	defer cancel()
+	ch, err := Watch(ctx, ms, `in/`, 10*time.Millisecond, WatchOptions{Checkpoint: cp, EmitExisting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, ch); e.Type != ObjectCreated || e.Name != `in/a.txt` {
+		t.Errorf(`unexpected event %+v`, e)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if snap, _ := cp.Load(bg); len(snap) != 1 {
+		t.Errorf(`expected checkpoint with 1 object, got %v`, snap)
+	}
+}
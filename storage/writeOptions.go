@@ -0,0 +1,159 @@
+package storage
+
+/*
+	object attributes applied when writing to, or updating objects within, a CStore
+*/
+import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/storage"
+	"compress/gzip"
+	"context"
+	"io"
+)
+
+// WriteOptions - optional attributes for a new object, zero values are left to the bucket defaults
+type WriteOptions struct {
+	// ContentType - the Mime content type
+	ContentType string
+	// InferContentType - when ContentType is empty, derive it from the object name or content (see DetectContentType)
+	InferContentType   bool
+	Metadata           map[string]string
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	// Gzip - compress the content during upload, ContentEncoding is set to "gzip".
+	// GCS will decompress the content when it is read back unless the client asks otherwise
+	Gzip bool
+	// StorageClass - e.g. STANDARD, NEARLINE, COLDLINE, ARCHIVE
+	StorageClass string
+	// KMSKeyName - Cloud KMS key used to encrypt the object, in the form projects/P/locations/L/keyRings/R/cryptoKeys/K
+	KMSKeyName string
+	// Conditions - optional generation preconditions, e.g. DoesNotExist or GenerationMatch.
+	// A failed precondition is reported as a PreconditionError
+	Conditions *storage.Conditions
+	// once - a single upload request, retried neither by the client library nor under the retry policy, for
+	// conditional writes whose caller must see a lost response rather than the failed precondition of a retry
+	once bool
+}
+
+// apply - copies the options to the attributes of a new object, e.g. those of a Writer prior to the first Write
+func (wo *WriteOptions) apply(w *storage.ObjectAttrs) {
+	if wo == nil {
+		return
+	}
+	w.ContentType = wo.ContentType
+	w.Metadata = wo.Metadata
+	w.CacheControl = wo.CacheControl
+	w.ContentDisposition = wo.ContentDisposition
+	w.ContentEncoding = wo.ContentEncoding
+	if wo.Gzip {
+		w.ContentEncoding = `gzip`
+	}
+	w.StorageClass = wo.StorageClass
+	w.KMSKeyName = wo.KMSKeyName
+}
+
+// metadata - the custom metadata in opts, which may be nil
+func (wo *WriteOptions) metadata() map[string]string {
+	if wo == nil {
+		return nil
+	}
+	return wo.Metadata
+}
+
+// contentType - the content type in opts, which may be nil
+func (wo *WriteOptions) contentType() string {
+	if wo == nil {
+		return ``
+	}
+	return wo.ContentType
+}
+
+// WriteCloudFileOpts - write data to a file in the google cloud, setting the attributes given in opts (which may be nil)
+func (cs *CStore) WriteCloudFileOpts(ctx context.Context, fn string, content []byte, opts *WriteOptions) error {
+	_, err := cs.WriteObject(ctx, fn, content, opts)
+	return err
+}
+
+// WriteObject - as WriteCloudFileOpts, returning the attributes of the new object (including its generation).
+// Writes conditional on a generation (or on the object not existing) are retried under the retry policy
+func (cs *CStore) WriteObject(ctx context.Context, fn string, content []byte, opts *WriteOptions) (*storage.ObjectAttrs, error) {
+	if opts == nil || opts.once || opts.Conditions == nil ||
+		(opts.Conditions.GenerationMatch == 0 && !opts.Conditions.DoesNotExist) {
+		return cs.writeOnce(ctx, fn, content, opts)
+	}
+	var a *storage.ObjectAttrs
+	oh := cs.object(ctx, fn)
+	err := cs.retry(ctx, fn, func(ctx context.Context) error {
+		var err error
+		a, _, err = writeObject(ctx, oh, bytes.NewReader(content), opts)
+		return err
+	})
+	return a, err
+}
+
+// writeOnce - as WriteObject, making a single attempt
+func (cs *CStore) writeOnce(ctx context.Context, fn string, content []byte, opts *WriteOptions) (*storage.ObjectAttrs, error) {
+	oh := cs.object(ctx, fn)
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	a, _, err := writeObject(ctx, oh, bytes.NewReader(content), opts)
+	return a, classify(fn, err)
+}
+
+// WriteFrom - stream the content of r to a file in the google cloud, setting the attributes given in opts (which may be nil)
+// returns the number of bytes read from r. The default timeout is not applied, as the size of the upload is unknown
+func (cs *CStore) WriteFrom(ctx context.Context, fn string, r io.Reader, opts *WriteOptions) (int64, error) {
+	_, n, err := writeObject(ctx, cs.object(ctx, fn), r, opts)
+	return n, err
+}
+
+// writeObject - copies r to the object, if r fails the upload is abandoned rather than committing a partial object
+func writeObject(ctx context.Context, oh *storage.ObjectHandle, r io.Reader, opts *WriteOptions) (*storage.ObjectAttrs, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts != nil {
+		oh = withConditions(oh, opts.Conditions)
+	}
+	wc := oh.NewWriter(ctx)
+	opts.apply(&wc.ObjectAttrs)
+	if opts != nil && opts.once {
+		// without a chunk size the content is not buffered, so the client library cannot resend it
+		wc.ChunkSize = 0
+	}
+	if opts != nil && opts.InferContentType && len(opts.ContentType) == 0 {
+		br := bufio.NewReaderSize(r, sniffLen)
+		head, _ := br.Peek(sniffLen)
+		wc.ContentType = DetectContentType(oh.ObjectName(), head)
+		r = br
+	}
+	var dest io.Writer = wc
+	var zw *gzip.Writer
+	if opts != nil && opts.Gzip {
+		zw = gzip.NewWriter(wc)
+		dest = zw
+	}
+	n, err := io.Copy(dest, r)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		cancel()
+		_ = wc.Close()
+		return nil, n, classify(oh.ObjectName(), err)
+	}
+	if err = wc.Close(); err != nil {
+		return nil, n, classify(oh.ObjectName(), err)
+	}
+	return wc.Attrs(), n, nil
+}
+
+// UpdateAttrs - patch the attributes of an existing object, only the fields set in ua are changed.
+// To remove a single custom metadata entry set its value in ua.Metadata to ""
+func (cs *CStore) UpdateAttrs(ctx context.Context, fn string, ua storage.ObjectAttrsToUpdate) (*storage.ObjectAttrs, error) {
+	ctx, cancel := cs.opContext(ctx)
+	defer cancel()
+	a, err := cs.object(ctx, fn).Update(ctx, ua)
+	return a, classify(fn, err)
+}
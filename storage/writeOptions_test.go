@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_WriteOptions(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	fn := testPath + `opts.txt`
+	opts := &WriteOptions{
+		ContentType:        `text/plain`,
+		Metadata:           map[string]string{`owner`: `test`},
+		CacheControl:       `no-cache`,
+		ContentDisposition: `attachment; filename="opts.txt"`,
+		Gzip:               true,
+	}
+	if e := cs.WriteCloudFileOpts(ctx, fn, []byte(fileContents), opts); e != nil {
+		t.Fatal(e)
+	}
+	defer deleteTestFiles(t, []string{fn})
+
+	a, e := cs.Attrs(ctx, fn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if a.ContentEncoding != `gzip` || a.CacheControl != `no-cache` || a.Metadata[`owner`] != `test` ||
+		a.ContentDisposition != opts.ContentDisposition {
+		t.Errorf(`attributes not applied: %+v`, a)
+	}
+
+	// content should be served decompressed
+	r, _, e := cs.GetFileReader(fn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != fileContents {
+		t.Errorf(`Expected "%s" got "%s"`, fileContents, b)
+	}
+
+	a, e = cs.UpdateAttrs(ctx, fn, storage.ObjectAttrsToUpdate{
+		CacheControl: `public, max-age=60`,
+		Metadata:     map[string]string{`owner`: ``, `reviewed`: `yes`},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if a.CacheControl != `public, max-age=60` || a.Metadata[`reviewed`] != `yes` {
+		t.Errorf(`attributes not updated: %+v`, a)
+	}
+	if _, ok := a.Metadata[`owner`]; ok {
+		t.Error(`metadata entry should have been removed`)
+	}
+
+	// streamed upload
+	fn2 := testPath + `stream.txt`
+	n, e := cs.WriteFrom(ctx, fn2, strings.NewReader(fileContents), &WriteOptions{ContentType: `text/plain`})
+	if e != nil || n != int64(len(fileContents)) {
+		t.Error(`WriteFrom failed`, n, e)
+	}
+	deleteTestFiles(t, []string{fn2})
+}
@@ -0,0 +1,821 @@
+// Package storagetest provides an in-process fake of the Google Cloud Storage JSON api, for hermetic tests of code
+// using the storage package. It supports the subset of the api used by storage.CStore: buckets (including
+// versioning, labels & IAM policies), object uploads (multipart, media & resumable), downloads (including ranges),
+// listing, metadata updates, conditions, rewrites, composition and customer supplied encryption keys.
+//
+// Create a store for a server with storage.NewCStoreWith(ctx, bucket, storage.WithEmulator(srv.URL))
+package storagetest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	raw "google.golang.org/api/storage/v1"
+)
+
+// object - a single generation of an object
+type object struct {
+	meta   raw.Object
+	data   []byte
+	keySHA string // customer supplied key (sha256, base64), if any
+}
+
+type bucket struct {
+	meta       raw.Bucket
+	objects    map[string]*object
+	noncurrent map[string][]*object // when versioning is enabled, oldest first
+	policy     []byte
+}
+
+// upload - a resumable upload session
+type upload struct {
+	bucket string
+	meta   raw.Object
+	query  url.Values
+	keySHA string
+	data   []byte
+	result *raw.Object // once complete
+}
+
+// Server - a fake GCS server, safe for concurrent use
+type Server struct {
+	*httptest.Server
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]*upload
+	gen     int64
+}
+
+// NewServer - starts a server holding the named (empty) buckets. Close the server when finished
+func NewServer(buckets ...string) *Server {
+	s := &Server{buckets: map[string]*bucket{}, uploads: map[string]*upload{}, gen: time.Now().UnixNano() / 1000}
+	for _, b := range buckets {
+		s.CreateBucket(b)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// CreateBucket - adds an empty bucket, replacing any existing bucket of that name
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[name] = newBucket(raw.Bucket{Name: name})
+}
+
+// Objects - the names of the current objects in the bucket, in order
+func (s *Server) Objects(bucketName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []string
+	if b, ok := s.buckets[bucketName]; ok {
+		for n := range b.objects {
+			result = append(result, n)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func newBucket(meta raw.Bucket) *bucket {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	meta.Kind, meta.Id, meta.Metageneration = `storage#bucket`, meta.Name, 1
+	meta.TimeCreated, meta.Updated = now, now
+	if meta.StorageClass == `` {
+		meta.StorageClass = `STANDARD`
+	}
+	if meta.Location == `` {
+		meta.Location = `US`
+	}
+	return &bucket{meta: meta, objects: map[string]*object{}, noncurrent: map[string][]*object{}}
+}
+
+func (b *bucket) versioning() bool {
+	return b.meta.Versioning != nil && b.meta.Versioning.Enabled
+}
+
+// find - the current object, or the given generation (when gen is not empty)
+func (b *bucket) find(name, gen string) *object {
+	o := b.objects[name]
+	if gen == `` {
+		return o
+	}
+	g, _ := strconv.ParseInt(gen, 10, 64)
+	if o != nil && o.meta.Generation == g {
+		return o
+	}
+	for _, v := range b.noncurrent[name] {
+		if v.meta.Generation == g {
+			return v
+		}
+	}
+	return nil
+}
+
+// replace - makes o the current generation, retaining the previous one if versioning is enabled
+func (b *bucket) replace(name string, o *object) {
+	if old, ok := b.objects[name]; ok && b.versioning() {
+		old.meta.TimeDeleted = time.Now().UTC().Format(time.RFC3339Nano)
+		b.noncurrent[name] = append(b.noncurrent[name], old)
+	}
+	if o == nil {
+		delete(b.objects, name)
+	} else {
+		b.objects[name] = o
+	}
+}
+
+// remove - deletes a specific generation
+func (b *bucket) remove(name string, o *object) {
+	if b.objects[name] == o {
+		delete(b.objects, name)
+		return
+	}
+	v := b.noncurrent[name]
+	for i := range v {
+		if v[i] == o {
+			b.noncurrent[name] = append(v[:i:i], v[i+1:]...)
+			break
+		}
+	}
+	if len(b.noncurrent[name]) == 0 {
+		delete(b.noncurrent, name)
+	}
+}
+
+// apiError - writes an error in the form returned by the JSON api
+func apiError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{`error`: map[string]interface{}{
+		`code`: code, `message`: message, `errors`: []map[string]string{{`message`: message}}}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// segments - the unescaped elements of the escaped path p
+func segments(p string) []string {
+	parts := strings.Split(strings.Trim(p, `/`), `/`)
+	for i, s := range parts {
+		if u, err := url.PathUnescape(s); err == nil {
+			parts[i] = u
+		}
+	}
+	return parts
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(p, `/storage/v1/`):
+		s.handleAPI(w, r, segments(strings.TrimPrefix(p, `/storage/v1/`)))
+	case strings.HasPrefix(p, `/upload/storage/v1/b/`):
+		s.handleUpload(w, r, segments(strings.TrimPrefix(p, `/upload/storage/v1/`)))
+	default:
+		s.handleDownload(w, r)
+	}
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request, seg []string) {
+	if seg[0] != `b` {
+		apiError(w, http.StatusNotFound, `not found`)
+		return
+	}
+	if len(seg) == 1 {
+		if r.Method == http.MethodPost {
+			s.createBucket(w, r)
+			return
+		}
+		apiError(w, http.StatusNotImplemented, `not supported`)
+		return
+	}
+	b, ok := s.buckets[seg[1]]
+	if !ok {
+		apiError(w, http.StatusNotFound, `bucket not found`)
+		return
+	}
+	switch {
+	case len(seg) == 2:
+		s.bucketRequest(w, r, seg[1], b)
+	case len(seg) == 3 && seg[2] == `iam`:
+		if r.Method == http.MethodPut {
+			b.policy, _ = ioutil.ReadAll(r.Body)
+		}
+		if b.policy == nil {
+			writeJSON(w, raw.Policy{Kind: `storage#policy`, ResourceId: `projects/_/buckets/` + seg[1]})
+			return
+		}
+		w.Header().Set(`Content-Type`, `application/json`)
+		_, _ = w.Write(b.policy)
+	case len(seg) == 3 && seg[2] == `o` && r.Method == http.MethodGet:
+		s.list(w, r, b)
+	case len(seg) == 4 && seg[2] == `o`:
+		s.objectRequest(w, r, b, seg[3])
+	case len(seg) == 5 && seg[2] == `o` && seg[4] == `compose` && r.Method == http.MethodPost:
+		s.compose(w, r, b, seg[3])
+	case len(seg) == 9 && seg[2] == `o` && seg[4] == `rewriteTo` && r.Method == http.MethodPost:
+		s.rewrite(w, r, b, seg[3], seg[6], seg[8])
+	default:
+		apiError(w, http.StatusNotImplemented, `not supported`)
+	}
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, r *http.Request) {
+	var meta raw.Bucket
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil || meta.Name == `` {
+		apiError(w, http.StatusBadRequest, `invalid bucket`)
+		return
+	}
+	if _, ok := s.buckets[meta.Name]; ok {
+		apiError(w, http.StatusConflict, `bucket already exists`)
+		return
+	}
+	b := newBucket(meta)
+	s.buckets[meta.Name] = b
+	writeJSON(w, b.meta)
+}
+
+func (s *Server) bucketRequest(w http.ResponseWriter, r *http.Request, name string, b *bucket) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, b.meta)
+	case http.MethodPatch, http.MethodPut:
+		if !mergeJSON(&b.meta, r.Body) {
+			apiError(w, http.StatusBadRequest, `invalid bucket`)
+			return
+		}
+		b.meta.Name, b.meta.Id = name, name
+		b.meta.Metageneration++
+		b.meta.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+		writeJSON(w, b.meta)
+	case http.MethodDelete:
+		if len(b.objects) > 0 || len(b.noncurrent) > 0 {
+			apiError(w, http.StatusConflict, `bucket is not empty`)
+			return
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, `method not allowed`)
+	}
+}
+
+// mergeJSON - applies the JSON merge patch in body to v (a null value removes a field)
+func mergeJSON(v interface{}, body io.Reader) bool {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return false
+	}
+	b, _ := json.Marshal(v)
+	var cur map[string]interface{}
+	_ = json.Unmarshal(b, &cur)
+	mergePatch(cur, patch)
+	b, _ = json.Marshal(cur)
+	return json.Unmarshal(b, v) == nil
+}
+
+func mergePatch(cur, patch map[string]interface{}) {
+	for k, pv := range patch {
+		if pv == nil {
+			delete(cur, k)
+			continue
+		}
+		pm, ok := pv.(map[string]interface{})
+		cm, ok2 := cur[k].(map[string]interface{})
+		if ok && ok2 {
+			mergePatch(cm, pm)
+			continue
+		}
+		if ok {
+			cm = map[string]interface{}{}
+			mergePatch(cm, pm)
+			pv = cm
+		}
+		cur[k] = pv
+	}
+}
+
+// listEntry - an object, or a prefix when delimiting
+type listEntry struct {
+	name string
+	obj  *object
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, b *bucket) {
+	q := r.URL.Query()
+	prefix, delim := q.Get(`prefix`), q.Get(`delimiter`)
+	start, end := q.Get(`startOffset`), q.Get(`endOffset`)
+	var all []*object
+	for _, o := range b.objects {
+		all = append(all, o)
+	}
+	if q.Get(`versions`) == `true` {
+		for _, v := range b.noncurrent {
+			all = append(all, v...)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].meta.Name != all[j].meta.Name {
+			return all[i].meta.Name < all[j].meta.Name
+		}
+		return all[i].meta.Generation < all[j].meta.Generation
+	})
+
+	var entries []listEntry
+	seen := map[string]bool{}
+	for _, o := range all {
+		n := o.meta.Name
+		if !strings.HasPrefix(n, prefix) || (start != `` && n < start) || (end != `` && n >= end) {
+			continue
+		}
+		if delim != `` {
+			if i := strings.Index(n[len(prefix):], delim); i >= 0 {
+				p := n[:len(prefix)+i+len(delim)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, listEntry{name: p})
+				}
+				continue
+			}
+		}
+		entries = append(entries, listEntry{name: n, obj: o})
+	}
+
+	offset, _ := strconv.Atoi(q.Get(`pageToken`))
+	max, _ := strconv.Atoi(q.Get(`maxResults`))
+	if max <= 0 || max > 1000 {
+		max = 1000
+	}
+	result := raw.Objects{Kind: `storage#objects`, Items: []*raw.Object{}}
+	for i := offset; i < len(entries) && i < offset+max; i++ {
+		if e := entries[i]; e.obj != nil {
+			m := e.obj.meta
+			result.Items = append(result.Items, &m)
+		} else {
+			result.Prefixes = append(result.Prefixes, e.name)
+		}
+	}
+	if offset+max < len(entries) {
+		result.NextPageToken = strconv.Itoa(offset + max)
+	}
+	writeJSON(w, result)
+}
+
+// checkConditions - the generation / metageneration preconditions in q (with the parameter prefix pfx, "" or
+// "Source") against o, which is nil if the object does not exist
+func checkConditions(q url.Values, pfx string, o *object) bool {
+	var gen, meta int64
+	if o != nil {
+		gen, meta = o.meta.Generation, o.meta.Metageneration
+	}
+	for param, want := range map[string]func(v int64) bool{
+		`if` + pfx + `GenerationMatch`:        func(v int64) bool { return v == gen },
+		`if` + pfx + `GenerationNotMatch`:     func(v int64) bool { return v != gen },
+		`if` + pfx + `MetagenerationMatch`:    func(v int64) bool { return o != nil && v == meta },
+		`if` + pfx + `MetagenerationNotMatch`: func(v int64) bool { return o != nil && v != meta },
+	} {
+		if s := q.Get(param); s != `` {
+			v, _ := strconv.ParseInt(s, 10, 64)
+			if !want(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// keySHA - the customer supplied key identified by the request headers, with the header prefix
+// "x-goog-" or "x-goog-copy-source-"
+func keySHA(r *http.Request, pfx string) string {
+	return r.Header.Get(pfx + `encryption-key-sha256`)
+}
+
+// checkKey - reports an error if the key supplied does not match the object's key
+func checkKey(w http.ResponseWriter, o *object, supplied string) bool {
+	if o.keySHA != supplied {
+		if o.keySHA == `` {
+			apiError(w, http.StatusBadRequest, `object is not encrypted with a customer supplied key`)
+		} else {
+			apiError(w, http.StatusBadRequest, `object is encrypted with a customer supplied key`)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *Server) objectRequest(w http.ResponseWriter, r *http.Request, b *bucket, name string) {
+	q := r.URL.Query()
+	o := b.find(name, q.Get(`generation`))
+	// as with GCS, a missing object is reported as such whatever the preconditions
+	if o == nil {
+		apiError(w, http.StatusNotFound, `object not found`)
+		return
+	}
+	if !checkConditions(q, ``, o) {
+		apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, o.meta)
+	case http.MethodPatch, http.MethodPut:
+		m := o.meta
+		if !mergeJSON(&m, r.Body) {
+			apiError(w, http.StatusBadRequest, `invalid object`)
+			return
+		}
+		// as with GCS, metadata entries set to "" are removed
+		for k, v := range m.Metadata {
+			if v == `` {
+				delete(m.Metadata, k)
+			}
+		}
+		// fields the caller cannot change
+		m.Bucket, m.Name, m.Id, m.Size, m.Generation = o.meta.Bucket, o.meta.Name, o.meta.Id, o.meta.Size, o.meta.Generation
+		m.Md5Hash, m.Crc32c, m.TimeCreated, m.Etag = o.meta.Md5Hash, o.meta.Crc32c, o.meta.TimeCreated, o.meta.Etag
+		m.Metageneration = o.meta.Metageneration + 1
+		m.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+		o.meta = m
+		writeJSON(w, o.meta)
+	case http.MethodDelete:
+		if q.Get(`generation`) != `` {
+			b.remove(name, o)
+		} else {
+			b.replace(name, nil)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, `method not allowed`)
+	}
+}
+
+// store - creates a new generation of name in b from meta and data, completing an upload. Returns nil on failure
+func (s *Server) store(w http.ResponseWriter, bucketName string, meta raw.Object, q url.Values, key string, data []byte) *object {
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		apiError(w, http.StatusNotFound, `bucket not found`)
+		return nil
+	}
+	if meta.Name == `` {
+		meta.Name = q.Get(`name`)
+	}
+	if meta.Name == `` {
+		apiError(w, http.StatusBadRequest, `object name required`)
+		return nil
+	}
+	if !checkConditions(q, ``, b.objects[meta.Name]) {
+		apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+		return nil
+	}
+	o := s.newObject(bucketName, meta, data, key)
+	b.replace(meta.Name, o)
+	writeJSON(w, o.meta)
+	return o
+}
+
+// newObject - a new generation, with the server maintained fields set
+func (s *Server) newObject(bucketName string, meta raw.Object, data []byte, key string) *object {
+	s.gen++
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	meta.Kind, meta.Bucket = `storage#object`, bucketName
+	meta.Generation, meta.Metageneration = s.gen, 1
+	meta.Id = fmt.Sprintf(`%s/%s/%d`, bucketName, meta.Name, s.gen)
+	meta.Size = uint64(len(data))
+	meta.TimeCreated, meta.Updated, meta.TimeDeleted = now, now, ``
+	if meta.ContentType == `` {
+		meta.ContentType = `application/octet-stream`
+	}
+	if meta.StorageClass == `` {
+		meta.StorageClass = `STANDARD`
+	}
+	sum := md5.Sum(data)
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	meta.Md5Hash, meta.Crc32c = base64.StdEncoding.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(c)
+	meta.Etag = base64.StdEncoding.EncodeToString(sum[:8])
+	meta.CustomerEncryption = nil
+	if key != `` {
+		meta.CustomerEncryption = &raw.ObjectCustomerEncryption{EncryptionAlgorithm: `AES256`, KeySha256: key}
+	}
+	return &object{meta: meta, data: data, keySHA: key}
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, seg []string) {
+	q := r.URL.Query()
+	if len(seg) != 3 || seg[0] != `b` || seg[2] != `o` {
+		apiError(w, http.StatusNotFound, `not found`)
+		return
+	}
+	if id := q.Get(`upload_id`); id != `` {
+		s.resume(w, r, id)
+		return
+	}
+	var meta raw.Object
+	switch q.Get(`uploadType`) {
+	case `media`:
+		data, _ := ioutil.ReadAll(r.Body)
+		meta.ContentType = r.Header.Get(`Content-Type`)
+		s.store(w, seg[1], meta, q, keySHA(r, `x-goog-`), data)
+	case `multipart`:
+		_, params, err := mime.ParseMediaType(r.Header.Get(`Content-Type`))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, `invalid multipart upload`)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params[`boundary`])
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&meta)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		if err != nil {
+			apiError(w, http.StatusBadRequest, `invalid multipart upload`)
+			return
+		}
+		data, _ := ioutil.ReadAll(part)
+		if meta.ContentType == `` {
+			meta.ContentType = part.Header.Get(`Content-Type`)
+		}
+		s.store(w, seg[1], meta, q, keySHA(r, `x-goog-`), data)
+	case `resumable`:
+		_ = json.NewDecoder(r.Body).Decode(&meta)
+		if meta.ContentType == `` {
+			meta.ContentType = r.Header.Get(`X-Upload-Content-Type`)
+		}
+		if _, ok := s.buckets[seg[1]]; !ok {
+			apiError(w, http.StatusNotFound, `bucket not found`)
+			return
+		}
+		s.gen++
+		id := strconv.FormatInt(s.gen, 36)
+		s.uploads[id] = &upload{bucket: seg[1], meta: meta, query: q, keySHA: keySHA(r, `x-goog-`)}
+		w.Header().Set(`Location`, s.URL+`/upload/storage/v1/b/`+url.PathEscape(seg[1])+`/o?uploadType=resumable&upload_id=`+id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		apiError(w, http.StatusBadRequest, `unsupported uploadType`)
+	}
+}
+
+// resume - a chunk of a resumable upload, or a query of its progress (an empty body with range bytes */*)
+func (s *Server) resume(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		apiError(w, http.StatusNotFound, `upload session not found`)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		delete(s.uploads, id)
+		w.WriteHeader(499)
+		return
+	}
+	// a completed session reports the object it created
+	if u.result != nil {
+		writeJSON(w, u.result)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	cr := strings.TrimPrefix(r.Header.Get(`Content-Range`), `bytes `)
+	total := int64(-1)
+	if i := strings.LastIndex(cr, `/`); i >= 0 {
+		if t, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+			total = t
+		}
+		cr = cr[:i]
+	}
+	if cr != `*` {
+		var first int64
+		if _, err := fmt.Sscanf(cr, `%d-`, &first); err != nil || first > int64(len(u.data)) {
+			apiError(w, http.StatusBadRequest, `invalid Content-Range`)
+			return
+		}
+		// bytes already received are ignored
+		if skip := int64(len(u.data)) - first; skip < int64(len(data)) {
+			u.data = append(u.data, data[skip:]...)
+		}
+	}
+	if total >= 0 && int64(len(u.data)) >= total {
+		if o := s.store(w, u.bucket, u.meta, u.query, u.keySHA, u.data[:total]); o != nil {
+			m := o.meta
+			u.result = &m
+		} else {
+			delete(s.uploads, id)
+		}
+		return
+	}
+	if len(u.data) > 0 {
+		w.Header().Set(`Range`, fmt.Sprintf(`bytes=0-%d`, len(u.data)-1))
+	}
+	if r.Header.Get(`X-GUploader-No-308`) == `yes` {
+		w.Header().Set(`X-HTTP-Status-Code-Override`, `308`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (s *Server) rewrite(w http.ResponseWriter, r *http.Request, src *bucket, srcName, destBucket, destName string) {
+	q := r.URL.Query()
+	o := src.find(srcName, q.Get(`sourceGeneration`))
+	if o == nil {
+		apiError(w, http.StatusNotFound, `object not found`)
+		return
+	}
+	if !checkConditions(q, `Source`, o) {
+		apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+		return
+	}
+	if !checkKey(w, o, keySHA(r, `x-goog-copy-source-`)) {
+		return
+	}
+	d, ok := s.buckets[destBucket]
+	if !ok {
+		apiError(w, http.StatusNotFound, `bucket not found`)
+		return
+	}
+	if !checkConditions(q, ``, d.objects[destName]) {
+		apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+		return
+	}
+	var meta raw.Object
+	_ = json.NewDecoder(r.Body).Decode(&meta)
+	// metadata supplied for the destination replaces that of the source
+	if meta.ContentType == `` && meta.Metadata == nil && meta.CacheControl == `` && meta.ContentEncoding == `` {
+		meta = o.meta
+	}
+	meta.Name = destName
+	n := s.newObject(destBucket, meta, o.data, keySHA(r, `x-goog-`))
+	d.replace(destName, n)
+	writeJSON(w, raw.RewriteResponse{Kind: `storage#rewriteResponse`, Done: true, ObjectSize: int64(len(o.data)),
+		TotalBytesRewritten: int64(len(o.data)), Resource: &n.meta})
+}
+
+func (s *Server) compose(w http.ResponseWriter, r *http.Request, b *bucket, destName string) {
+	var req raw.ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.SourceObjects) == 0 || len(req.SourceObjects) > 32 {
+		apiError(w, http.StatusBadRequest, `invalid compose request`)
+		return
+	}
+	key := keySHA(r, `x-goog-`)
+	var data []byte
+	for _, so := range req.SourceObjects {
+		gen := ``
+		if so.Generation != 0 {
+			gen = strconv.FormatInt(so.Generation, 10)
+		}
+		o := b.find(so.Name, gen)
+		if o == nil {
+			apiError(w, http.StatusNotFound, `object not found: `+so.Name)
+			return
+		}
+		if so.ObjectPreconditions != nil && so.ObjectPreconditions.IfGenerationMatch != 0 &&
+			so.ObjectPreconditions.IfGenerationMatch != o.meta.Generation {
+			apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+			return
+		}
+		if !checkKey(w, o, key) {
+			return
+		}
+		data = append(data, o.data...)
+	}
+	q := r.URL.Query()
+	if !checkConditions(q, ``, b.objects[destName]) {
+		apiError(w, http.StatusPreconditionFailed, `conditionNotMet`)
+		return
+	}
+	var meta raw.Object
+	if req.Destination != nil {
+		meta = *req.Destination
+	}
+	meta.Name = destName
+	o := s.newObject(b.meta.Name, meta, data, key)
+	o.meta.ComponentCount = int64(len(req.SourceObjects))
+	b.replace(destName, o)
+	writeJSON(w, o.meta)
+}
+
+// handleDownload - media requests of the form /bucket/object
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		apiError(w, http.StatusMethodNotAllowed, `method not allowed`)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, `/`)
+	i := strings.Index(path, `/`)
+	if i < 0 {
+		apiError(w, http.StatusNotFound, `not found`)
+		return
+	}
+	b, ok := s.buckets[path[:i]]
+	if !ok {
+		http.Error(w, `bucket not found`, http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	o := b.find(path[i+1:], q.Get(`generation`))
+	if !checkConditions(q, ``, o) {
+		http.Error(w, `conditionNotMet`, http.StatusPreconditionFailed)
+		return
+	}
+	if o == nil {
+		http.Error(w, `object not found`, http.StatusNotFound)
+		return
+	}
+	if !checkKey(w, o, keySHA(r, `x-goog-`)) {
+		return
+	}
+
+	data := o.data
+	h := w.Header()
+	h.Set(`X-Goog-Stored-Content-Encoding`, `identity`)
+	transcoded := o.meta.ContentEncoding == `gzip`
+	if transcoded {
+		// served decompressed, as GCS does for clients that do not request compressed content
+		h.Set(`X-Goog-Stored-Content-Encoding`, `gzip`)
+		if zr, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			data, _ = ioutil.ReadAll(zr)
+		}
+	} else {
+		h.Set(`X-Goog-Hash`, `crc32c=`+o.meta.Crc32c+`,md5=`+o.meta.Md5Hash)
+	}
+	h.Set(`Content-Type`, o.meta.ContentType)
+	h.Set(`X-Goog-Generation`, strconv.FormatInt(o.meta.Generation, 10))
+	h.Set(`X-Goog-Metageneration`, strconv.FormatInt(o.meta.Metageneration, 10))
+	h.Set(`ETag`, `"`+o.meta.Etag+`"`)
+	if t, err := time.Parse(time.RFC3339Nano, o.meta.Updated); err == nil {
+		h.Set(`Last-Modified`, t.Format(http.TimeFormat))
+	}
+	if o.meta.CacheControl != `` {
+		h.Set(`Cache-Control`, o.meta.CacheControl)
+	}
+
+	size := int64(len(data))
+	start, end, partial := int64(0), size-1, false
+	if rg := strings.TrimPrefix(r.Header.Get(`Range`), `bytes=`); rg != `` && rg != r.Header.Get(`Range`) {
+		partial = true
+		if strings.HasPrefix(rg, `-`) {
+			n, _ := strconv.ParseInt(rg[1:], 10, 64)
+			if start = size - n; start < 0 {
+				start = 0
+			}
+		} else {
+			parts := strings.SplitN(rg, `-`, 2)
+			start, _ = strconv.ParseInt(parts[0], 10, 64)
+			if len(parts) == 2 && parts[1] != `` {
+				if e, err := strconv.ParseInt(parts[1], 10, 64); err == nil && e < end {
+					end = e
+				}
+			}
+		}
+		if start >= size && size > 0 {
+			h.Set(`Content-Range`, fmt.Sprintf(`bytes */%d`, size))
+			http.Error(w, `range not satisfiable`, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	if end < start {
+		end = start - 1
+	}
+	if partial || !transcoded {
+		h.Set(`Content-Length`, strconv.FormatInt(end-start+1, 10))
+	}
+	if partial {
+		h.Set(`Content-Range`, fmt.Sprintf(`bytes %d-%d/%d`, start, end, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else if transcoded {
+		// as with GCS, the length of decompressed content is not known in advance
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data[start : end+1])
+	}
+}
@@ -0,0 +1,55 @@
+package storagetest_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/cambefus/gcp_go_utils/storage"
+	"github.com/cambefus/gcp_go_utils/storagetest"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := storagetest.NewServer(`bucket`)
+	defer srv.Close()
+	ctx := context.Background()
+	cs, err := storage.NewCStoreWith(ctx, `bucket`, storage.WithEmulator(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// a resumable upload, in several chunks
+	data := make([]byte, 600<<10)
+	rand.Read(data)
+	w := cs.Client().Bucket(`bucket`).Object(`dir/big.bin`).NewWriter(ctx)
+	w.ChunkSize = 256 << 10
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.WriteFile(`dir/sub/a.txt`, `a`); err != nil {
+		t.Fatal(err)
+	}
+	if o := srv.Objects(`bucket`); len(o) != 2 || o[0] != `dir/big.bin` {
+		t.Errorf(`unexpected objects %v`, o)
+	}
+
+	r, err := cs.Client().Bucket(`bucket`).Object(`dir/big.bin`).NewRangeReader(ctx, 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(b, data[1000:1010]) {
+		t.Error(`unexpected range content`)
+	}
+
+	prefixes, objects, err := cs.ListDir(ctx, `dir/`)
+	if err != nil || len(prefixes) != 1 || prefixes[0] != `dir/sub/` || len(objects) != 1 || objects[0].Size != int64(len(data)) {
+		t.Errorf(`unexpected listing %v %v %v`, prefixes, objects, err)
+	}
+}